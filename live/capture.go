@@ -0,0 +1,91 @@
+package live
+
+import (
+	"time"
+
+	"github.com/chewxy/gopherconsg2018/midiio"
+	"github.com/chewxy/gopherconsg2018/model"
+)
+
+// capture turns the player's live MIDI events into a sequence of messages, the same way the decoder does for MIDI files:
+// notes are ordered by when they start, each note lasts from its own NoteOn to its own NoteOff,
+// and a rest is added only when no notes are held (and it has a length). Events other than NoteOn and NoteOff are ignored.
+type capture struct {
+	msgs      []model.Message
+	starts    []int64                  // when each of the messages started
+	held      map[midiio.NoteKey][]int // indices of the held notes of each key, oldest first
+	sounding  int
+	restStart int64 // -1 if notes are held (or nothing has been played)
+	offset    int64 // wall clock milliseconds - event timestamp
+}
+
+func newCapture() *capture {
+	return &capture{
+		held:      make(map[midiio.NoteKey][]int),
+		restStart: -1,
+	}
+}
+
+func millis(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) }
+
+// add adds an event that was received at the given time. If the event is a note event, it returns the message to display.
+func (c *capture) add(ev midiio.Event, at time.Time) (m model.Message, ok bool) {
+	typ, ch := midiio.ParseStatus(byte(ev.Status))
+	key, vel := midiio.ParseData(byte(ev.Data1)), midiio.ParseData(byte(ev.Data2))
+	if typ != midiio.NoteOnStatus && typ != midiio.NoteOffStatus {
+		return model.Message{}, false
+	}
+	c.offset = millis(at) - ev.Timestamp
+	k := midiio.NoteKey{Channel: ch, Key: key}
+
+	if typ == midiio.NoteOffStatus || vel == 0 {
+		waiting := c.held[k]
+		if len(waiting) == 0 {
+			return model.Message{}, false // a note that was already taken, or was never played
+		}
+		i := waiting[0]
+		c.held[k] = waiting[1:]
+		c.msgs[i].Duration = uint(ev.Timestamp - c.starts[i])
+		if c.sounding--; c.sounding == 0 {
+			c.restStart = ev.Timestamp
+		}
+		return model.Message{Channel: ch, Key: key, Velocity: 0}, true
+	}
+
+	if c.restStart >= 0 && ev.Timestamp > c.restStart && len(c.msgs) > 0 {
+		c.msgs = append(c.msgs, model.Message{
+			Channel:  ch,
+			Key:      model.Rest,
+			Duration: uint(ev.Timestamp - c.restStart),
+		})
+		c.starts = append(c.starts, c.restStart)
+	}
+	c.restStart = -1
+
+	c.msgs = append(c.msgs, model.Message{Channel: ch, Key: key, Velocity: vel})
+	c.starts = append(c.starts, ev.Timestamp)
+	c.held[k] = append(c.held[k], len(c.msgs)-1)
+	c.sounding++
+	return model.Message{Channel: ch, Key: key, Velocity: vel}, true
+}
+
+func (c *capture) empty() bool { return len(c.msgs) == 0 }
+
+// take returns the captured phrase and when it started, and starts a new one. Notes that are still held end now.
+func (c *capture) take(now time.Time) (msgs []model.Message, start time.Time) {
+	ts := millis(now) - c.offset
+	if len(c.starts) > 0 {
+		start = time.Unix(0, (c.starts[0]+c.offset)*int64(time.Millisecond))
+	}
+	for k, waiting := range c.held {
+		for _, i := range waiting {
+			c.msgs[i].Duration = uint(ts - c.starts[i])
+		}
+		delete(c.held, k)
+	}
+	msgs = c.msgs
+	c.msgs, c.starts = nil, nil
+	c.sounding = 0
+	c.restStart = -1
+	return msgs, start
+}
@@ -0,0 +1,202 @@
+package live
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chewxy/gopherconsg2018/midiio"
+	"github.com/chewxy/gopherconsg2018/model"
+)
+
+var epoch = time.Date(2018, 4, 26, 9, 0, 0, 0, time.UTC)
+
+// ev is an event that was received ts milliseconds after epoch
+func ev(ts, status, data1, data2 int64) midiio.Event {
+	return midiio.Event{Timestamp: ts, Status: status, Data1: data1, Data2: data2}
+}
+
+func received(e midiio.Event) time.Time {
+	return epoch.Add(time.Duration(e.Timestamp) * time.Millisecond)
+}
+
+func note(ch, key byte, dur uint, vel byte) model.Message {
+	return model.Message{Channel: ch, Key: key, Duration: dur, Velocity: vel}
+}
+
+func rest(ch byte, dur uint) model.Message {
+	return model.Message{Channel: ch, Key: model.Rest, Duration: dur}
+}
+
+func TestCapture(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []midiio.Event
+		end    int64 // when the phrase is taken
+		want   []model.Message
+	}{
+		{
+			name:   "note",
+			events: []midiio.Event{ev(0, 0x90, 60, 100), ev(500, 0x80, 60, 0)},
+			end:    1000,
+			want:   []model.Message{note(0, 60, 500, 100)},
+		},
+		{
+			name:   "NoteOn with velocity 0 ends a note",
+			events: []midiio.Event{ev(0, 0x90, 60, 100), ev(500, 0x90, 60, 0)},
+			end:    1000,
+			want:   []model.Message{note(0, 60, 500, 100)},
+		},
+		{
+			name:   "chord",
+			events: []midiio.Event{ev(0, 0x90, 60, 100), ev(0, 0x90, 64, 90), ev(400, 0x80, 60, 0), ev(500, 0x80, 64, 0)},
+			end:    1000,
+			want:   []model.Message{note(0, 60, 400, 100), note(0, 64, 500, 90)},
+		},
+		{
+			name:   "legato",
+			events: []midiio.Event{ev(0, 0x90, 60, 100), ev(300, 0x90, 62, 100), ev(320, 0x80, 60, 0), ev(600, 0x80, 62, 0)},
+			end:    1000,
+			want:   []model.Message{note(0, 60, 320, 100), note(0, 62, 300, 100)},
+		},
+		{
+			name:   "rest",
+			events: []midiio.Event{ev(0, 0x90, 60, 100), ev(200, 0x80, 60, 0), ev(500, 0x90, 62, 100), ev(700, 0x80, 62, 0)},
+			end:    1000,
+			want:   []model.Message{note(0, 60, 200, 100), rest(0, 300), note(0, 62, 200, 100)},
+		},
+		{
+			name:   "no rest between a note and the next one that starts as it ends",
+			events: []midiio.Event{ev(0, 0x90, 60, 100), ev(200, 0x80, 60, 0), ev(200, 0x90, 62, 100), ev(400, 0x80, 62, 0)},
+			end:    1000,
+			want:   []model.Message{note(0, 60, 200, 100), note(0, 62, 200, 100)},
+		},
+		{
+			name:   "repeated key",
+			events: []midiio.Event{ev(0, 0x90, 60, 100), ev(100, 0x90, 60, 80), ev(200, 0x80, 60, 0), ev(300, 0x80, 60, 0)},
+			end:    1000,
+			want:   []model.Message{note(0, 60, 200, 100), note(0, 60, 200, 80)},
+		},
+		{
+			name:   "a NoteOff only ends a note of its own channel",
+			events: []midiio.Event{ev(0, 0x90, 60, 100), ev(100, 0x91, 60, 100), ev(200, 0x81, 60, 0), ev(300, 0x80, 60, 0)},
+			end:    1000,
+			want:   []model.Message{note(0, 60, 300, 100), note(1, 60, 100, 100)},
+		},
+		{
+			name: "other messages are ignored",
+			events: []midiio.Event{
+				ev(0, 0xB0, 64, 127), // sustain
+				ev(0, 0x90, 60, 100),
+				ev(50, 0xE0, 0, 80),  // pitch bend
+				ev(60, 0xA0, 60, 30), // aftertouch
+				ev(70, 0xD0, 40, 0),  // channel pressure
+				ev(80, 0xC0, 12, 0),  // program change
+				ev(100, 0x80, 61, 0), // never played
+				ev(200, 0x80, 60, 0),
+				ev(300, 0xB0, 64, 0),
+			},
+			end:  1000,
+			want: []model.Message{note(0, 60, 200, 100)},
+		},
+		{
+			name:   "held notes end when the phrase is taken",
+			events: []midiio.Event{ev(0, 0x90, 60, 100), ev(100, 0x90, 64, 100), ev(300, 0x80, 64, 0)},
+			end:    800,
+			want:   []model.Message{note(0, 60, 800, 100), note(0, 64, 200, 100)},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newCapture()
+			for _, e := range tc.events {
+				c.add(e, received(e))
+			}
+			got, start := c.take(epoch.Add(time.Duration(tc.end) * time.Millisecond))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Got %v. Want %v", got, tc.want)
+			}
+			if !start.Equal(epoch) {
+				t.Errorf("The phrase started at %v. Want %v", start, epoch)
+			}
+			if !c.empty() {
+				t.Error("Expected the capture to be empty after the phrase was taken")
+			}
+		})
+	}
+}
+
+// TestCapturePhrases feeds recorded performances through the phrase detector and the capture, the way the loop does.
+func TestCapturePhrases(t *testing.T) {
+	tests := []struct {
+		name     string
+		detector *PhraseDetector
+		events   []midiio.Event
+		want     [][]model.Message
+	}{
+		{
+			name:     "silence ends a phrase",
+			detector: NewPhraseDetector(time.Second, 0, -1, -1),
+			events: []midiio.Event{
+				ev(0, 0x90, 60, 100), ev(400, 0x80, 60, 0), ev(600, 0x90, 62, 100), ev(900, 0x80, 62, 0),
+				ev(2500, 0x90, 64, 100), ev(2800, 0x80, 64, 0),
+			},
+			want: [][]model.Message{
+				{note(0, 60, 400, 100), rest(0, 200), note(0, 62, 300, 100)},
+				{note(0, 64, 300, 100)},
+			},
+		},
+		{
+			name:     "the trigger ends a phrase and is not captured",
+			detector: NewPhraseDetector(time.Hour, 0, 64, -1),
+			events: []midiio.Event{
+				ev(0, 0x90, 60, 100), ev(400, 0x80, 60, 0), ev(500, 0xB0, 64, 127),
+				ev(600, 0xB0, 64, 0), ev(700, 0x90, 62, 100), ev(900, 0x80, 62, 0),
+			},
+			want: [][]model.Message{
+				{note(0, 60, 400, 100)},
+				{note(0, 62, 200, 100)},
+			},
+		},
+		{
+			name:     "the trigger key is not captured",
+			detector: NewPhraseDetector(time.Hour, 0, -1, 108),
+			events: []midiio.Event{
+				ev(0, 0x90, 60, 100), ev(400, 0x80, 60, 0), ev(450, 0x90, 108, 100), ev(500, 0x80, 108, 0),
+			},
+			want: [][]model.Message{
+				{note(0, 60, 400, 100)},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			det, c := tc.detector, newCapture()
+			var got [][]model.Message
+			take := func(now time.Time) {
+				if msgs, _ := c.take(now); len(msgs) > 0 {
+					got = append(got, msgs)
+				}
+				det.reset()
+			}
+			for _, e := range tc.events {
+				now := received(e)
+				if det.ended(now) { // the loop's timer would have fired
+					take(now)
+				}
+				if !det.observe(e, now) {
+					c.add(e, now)
+				}
+				if det.ended(now) {
+					take(now)
+				}
+			}
+			take(received(tc.events[len(tc.events)-1]).Add(time.Hour))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Got %v. Want %v", got, tc.want)
+			}
+		})
+	}
+}
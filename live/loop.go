@@ -0,0 +1,157 @@
+// Package live plays call and response with a performer over MIDI: it listens to the performer's phrases,
+// predicts a response with the model and plays it back, while the model is trained in the background.
+package live
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/chewxy/gopherconsg2018/metrics"
+	"github.com/chewxy/gopherconsg2018/midiio"
+	"github.com/chewxy/gopherconsg2018/model"
+)
+
+// Loop listens to the player, and plays the machine's response when the player's phrase ends.
+type Loop struct {
+	In  midiio.In
+	Out midiio.Out
+
+	// Model is owned by the loop. Its weights are replaced by the latest ones in Models between phrases. Models may be nil
+	Model  *model.Seq2Seq
+	Models *model.Holder
+
+	Detector *PhraseDetector
+	Panic    PanicControl
+	Voicing  Voicing
+	Recorder *Recorder // may be nil
+
+	// Observers of the loop. They are called from the loop and from the playback, must not block, and may be nil
+	OnNote    func(msg model.Message, machine bool)        // every note that the player or the machine starts or stops
+	OnPhrase  func(role midiio.Role, msgs []model.Message) // the player's phrase when it ends, and the machine's response when it starts
+	OnPredict func(model.Probabilities)                    // the predictions for each message of the response
+
+	Log *slog.Logger // nil logs to the default logger
+}
+
+// Run runs the loop. It blocks until there is an event or the end of phrase timer fires, so it does not use any CPU while waiting.
+//
+// Run returns when the context is cancelled or the input is closed, or with an error if predicting fails.
+// The caller silences and closes the streams, so the loop can be restarted.
+func (l *Loop) Run(ctx context.Context) error {
+	ch := l.In.Listen()
+	c := newCapture()
+	det := l.Detector
+
+	log := logger(l.Log)
+	p := &player{out: l.Out, voicing: l.Voicing, onNote: l.OnNote, log: log}
+	phrase := func(role midiio.Role, msgs []model.Message) {
+		if l.OnPhrase != nil {
+			l.OnPhrase(role, msgs)
+		}
+	}
+	defer p.interrupt()
+	for _, prog := range l.Voicing.programChanges() {
+		p.Write(prog)
+	}
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+	arm := func(d time.Duration) {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(d)
+	}
+	var version int
+	respond := func(now time.Time) error {
+		defer det.reset()
+		if msgs, start := c.take(now); len(msgs) > 0 {
+			phrase(midiio.CallRole, msgs)
+			metrics.CallLength.Observe(float64(len(msgs)))
+
+			// pick up the latest weights between phrases
+			if l.Models != nil {
+				var err error
+				if version, err = l.Models.Update(l.Model, version); err != nil {
+					log.Warn("Unable to update model", "err", err)
+				}
+			}
+
+			// play output from computer
+			predicting := time.Now()
+			pred, err := l.Model.PredictWith(msgs, model.SampleOptions{OnStep: l.OnPredict})
+			if err != nil {
+				return err
+			}
+			metrics.PredictLatency.ObserveDuration(time.Since(predicting))
+			metrics.ResponseLength.Observe(float64(len(pred)))
+			log.Debug("Responding", "call", len(msgs), "response", len(pred), "latency", time.Since(predicting))
+
+			responded := time.Now()
+			phrase(midiio.ResponseRole, pred)
+			p.write(pred)
+			if l.Recorder != nil {
+				if err := l.Recorder.Record(msgs, start, pred, responded, responded.Sub(now)); err != nil {
+					log.Warn("Unable to record session", "err", err)
+				}
+			}
+		}
+		return nil
+	}
+
+	for {
+		var now time.Time
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			now = time.Now()
+			metrics.MIDIIn.Add(1)
+			if ok, pressed := l.Panic.matches(ev); ok {
+				if pressed {
+					log.Info("Panic")
+					// drop everything: the response, the player's phrase and anything that is still sounding
+					p.interrupt()
+					c.take(now)
+					det.reset()
+					if err := midiio.StopAllNotes(l.Out); err != nil {
+						log.Warn("Unable to stop all notes", "err", err)
+					}
+				}
+				continue
+			}
+			// log.Printf("RECEIVED %v %v %v", ev, byte(ev.Data1), ev.Data1)
+			// input from user
+			if !det.observe(ev, now) {
+				if m, ok := c.add(ev, now); ok {
+					if m.Velocity > 0 {
+						p.interrupt() // the player has started again
+					}
+					if l.OnNote != nil {
+						l.OnNote(m, false)
+					}
+				}
+				l.Out.WriteShort(ev.Status, ev.Data1, ev.Data2)
+			}
+		case <-timer.C:
+			now = time.Now()
+		case <-ctx.Done():
+			return nil
+		}
+
+		switch {
+		case det.ended(now):
+			if err := respond(now); err != nil {
+				return err
+			}
+		case !c.empty():
+			arm(det.remaining(now))
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package live
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/chewxy/gopherconsg2018/midiio"
+	"github.com/chewxy/gopherconsg2018/model"
+)
+
+type phraseEvent struct {
+	role midiio.Role
+	msgs []model.Message
+	at   time.Time
+}
+
+// newTestLoop makes a loop that plays with an untrained model on a fake device, and reports the phrases on the returned channel.
+func newTestLoop(silence time.Duration) (*Loop, *midiio.Fake, <-chan phraseEvent) {
+	f := midiio.NewFake()
+	phrases := make(chan phraseEvent, 16)
+	l := &Loop{
+		In:       f,
+		Out:      f,
+		Model:    model.New(model.Config{HiddenSize: 8, EmbeddingSize: 4}, []byte{60, 62, 64}, []uint{100, 200}),
+		Detector: NewPhraseDetector(silence, 0, -1, -1),
+		Panic:    PanicControl{CC: -1, Key: -1},
+		Voicing:  Voicing{Velocity: 100},
+		OnPhrase: func(role midiio.Role, msgs []model.Message) {
+			phrases <- phraseEvent{role, msgs, time.Now()}
+		},
+		Log: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	return l, f, phrases
+}
+
+// run runs the loop in the background. The returned channel receives what Run returns.
+func run(l *Loop) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- l.Run(context.Background()) }()
+	return done
+}
+
+func waitPhrase(t *testing.T, phrases <-chan phraseEvent, timeout time.Duration) phraseEvent {
+	t.Helper()
+	select {
+	case p := <-phrases:
+		return p
+	case <-time.After(timeout):
+		t.Fatalf("No phrase after %v", timeout)
+	}
+	return phraseEvent{}
+}
+
+func waitRun(t *testing.T, done <-chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after the input was closed")
+	}
+}
+
+func TestLoopResponds(t *testing.T) {
+	l, f, phrases := newTestLoop(50 * time.Millisecond)
+	done := run(l)
+
+	f.Send(0x90, 60, 100)
+	f.Send(0xB0, 1, 64) // modulation is passed through but not captured
+	time.Sleep(20 * time.Millisecond)
+	f.Send(0x90, 64, 90)
+	f.Send(0x80, 60, 0)
+	f.Send(0x90, 64, 0)
+
+	call := waitPhrase(t, phrases, time.Second)
+	if call.role != midiio.CallRole {
+		t.Fatalf("Got a phrase of role %v. Expected the call", call.role)
+	}
+	if len(call.msgs) != 2 || call.msgs[0].Key != 60 || call.msgs[0].Velocity != 100 || call.msgs[1].Key != 64 || call.msgs[1].Velocity != 90 {
+		t.Fatalf("Got call %v. Expected 60 and 64", call.msgs)
+	}
+	if d := call.msgs[0].Duration; d < 15 || d > 500 {
+		t.Errorf("The first note lasted %dms. Expected about 20ms", d)
+	}
+	if response := waitPhrase(t, phrases, time.Second); response.role != midiio.ResponseRole {
+		t.Errorf("Got a phrase of role %v. Expected the response", response.role)
+	}
+
+	f.Close()
+	waitRun(t, done)
+
+	var passed int
+	for _, ev := range f.Written() {
+		if ev.Status == 0xB0 && ev.Data1 == 1 {
+			passed++
+		}
+	}
+	if passed != 1 {
+		t.Errorf("The control change was written %d times. Expected it to be passed through once", passed)
+	}
+}
+
+func TestLoopStopsWhenInputCloses(t *testing.T) {
+	l, f, phrases := newTestLoop(time.Hour)
+	done := run(l)
+	f.Send(0x90, 60, 100)
+	f.Close()
+	waitRun(t, done)
+	select {
+	case p := <-phrases:
+		t.Errorf("Got a phrase %v after the input was closed", p)
+	default:
+	}
+}
+
+func TestLoopPanic(t *testing.T) {
+	l, f, phrases := newTestLoop(50 * time.Millisecond)
+	l.Panic = PanicControl{CC: -1, Key: 21}
+	done := run(l)
+
+	f.Send(0x90, 60, 100)
+	f.Send(0x90, 21, 100) // panic: the phrase is dropped
+	f.Send(0x80, 21, 0)
+	time.Sleep(150 * time.Millisecond)
+	select {
+	case p := <-phrases:
+		t.Errorf("Got a phrase %v after a panic", p)
+	default:
+	}
+
+	f.Close()
+	waitRun(t, done)
+	var stopped bool
+	for _, ev := range f.Written() {
+		if ev.Status == 0xB0 && ev.Data1 == 123 { // all notes off
+			stopped = true
+		}
+	}
+	if !stopped {
+		t.Error("Expected all notes to be stopped after a panic")
+	}
+}
+
+func TestLoopWakesOnPhraseDeadline(t *testing.T) {
+	const silence = 150 * time.Millisecond
+	l, f, phrases := newTestLoop(silence)
+	done := run(l)
+
+	f.Send(0x90, 60, 100)
+	f.Send(0x80, 60, 0)
+	last := time.Now()
+	call := waitPhrase(t, phrases, 2*time.Second)
+	if waited := call.at.Sub(last); waited < silence || waited > silence+250*time.Millisecond {
+		t.Errorf("The phrase ended %v after the last event. Expected it to end after %v of silence", waited, silence)
+	}
+
+	f.Close()
+	waitRun(t, done)
+}
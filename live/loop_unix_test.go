@@ -0,0 +1,48 @@
+//go:build unix
+
+package live
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+// cpuTime returns the CPU time that the process has used so far.
+func cpuTime(t *testing.T) time.Duration {
+	t.Helper()
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		t.Fatal(err)
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// TestLoopIdles checks that the loop blocks while no events arrive, both before anything is played and while it waits for the end of a phrase.
+// A loop that polls keeps a core busy for the whole time.
+func TestLoopIdles(t *testing.T) {
+	const idle = 300 * time.Millisecond
+	l, f, phrases := newTestLoop(time.Hour)
+	done := run(l)
+
+	check := func(when string) {
+		before := cpuTime(t)
+		time.Sleep(idle)
+		if used := cpuTime(t) - before; used > idle/3 {
+			t.Errorf("%v: the process used %v of CPU in %v with no events", when, used, idle)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	check("Before playing")
+	f.Send(0x90, 60, 100)
+	f.Send(0x80, 60, 0)
+	check("Waiting for the end of the phrase")
+
+	f.Close()
+	waitRun(t, done)
+	select {
+	case p := <-phrases:
+		t.Errorf("Got a phrase %v before the end of the phrase", p)
+	default:
+	}
+}
@@ -0,0 +1,23 @@
+package live
+
+import "github.com/chewxy/gopherconsg2018/midiio"
+
+// PanicControl is the key or control change that the performer plays to stop all the notes (and the machine's response) at once.
+type PanicControl struct {
+	CC  int // -1 to disable
+	Key int // -1 to disable
+}
+
+// matches returns true if the event is the panic key or control change, which should not be played or recorded.
+// pressed is true if the panic was pressed (rather than released).
+func (p PanicControl) matches(ev midiio.Event) (ok, pressed bool) {
+	typ, _ := midiio.ParseStatus(byte(ev.Status))
+	data1, data2 := midiio.ParseData(byte(ev.Data1)), midiio.ParseData(byte(ev.Data2))
+	switch {
+	case typ == midiio.ControlChangeStatus && int(data1) == p.CC:
+		return true, data2 >= 64
+	case (typ == midiio.NoteOnStatus || typ == midiio.NoteOffStatus) && int(data1) == p.Key:
+		return true, typ == midiio.NoteOnStatus && data2 > 0
+	}
+	return false, false
+}
@@ -0,0 +1,131 @@
+package live
+
+import (
+	"sort"
+	"time"
+
+	"github.com/chewxy/gopherconsg2018/midiio"
+)
+
+const (
+	maxOnsets     = 16              // number of recent inter-onset intervals used to estimate the tempo
+	maxIOI        = 2 * time.Second // longer intervals are pauses, not part of the tempo
+	minBeat       = 300 * time.Millisecond
+	maxBeat       = 1000 * time.Millisecond
+	minTempoNotes = 4
+)
+
+// tempoEstimator estimates the length of a beat from the intervals between recent note onsets.
+type tempoEstimator struct {
+	last time.Time
+	iois []time.Duration
+}
+
+func (t *tempoEstimator) onset(at time.Time) {
+	if !t.last.IsZero() {
+		if ioi := at.Sub(t.last); ioi > 0 && ioi < maxIOI {
+			t.iois = append(t.iois, ioi)
+			if len(t.iois) > maxOnsets {
+				t.iois = t.iois[1:]
+			}
+		}
+	}
+	t.last = at
+}
+
+// beat returns the median inter-onset interval, doubled or halved until it is a plausible beat length (60 to 200 BPM).
+func (t *tempoEstimator) beat() (time.Duration, bool) {
+	if len(t.iois) < minTempoNotes {
+		return 0, false
+	}
+	sorted := make([]time.Duration, len(t.iois))
+	copy(sorted, t.iois)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	beat := sorted[len(sorted)/2]
+	for beat < minBeat {
+		beat *= 2
+	}
+	for beat >= maxBeat {
+		beat /= 2
+	}
+	return beat, true
+}
+
+// PhraseDetector decides when the human has finished playing a phrase, and it is the machine's turn.
+//
+// A phrase ends after a period of silence, which is either a fixed time or, if beats is set and the tempo can be estimated, a number of beats.
+// A phrase also ends immediately when the trigger is played: either a control change (e.g. 64, the sustain pedal) being pressed, or a key.
+type PhraseDetector struct {
+	silence    time.Duration
+	beats      float64
+	triggerCC  int // -1 to disable
+	triggerKey int // -1 to disable
+
+	tempo     tempoEstimator
+	last      time.Time
+	triggered bool
+}
+
+// NewPhraseDetector creates a phrase detector. A trigger of -1 is disabled.
+func NewPhraseDetector(silence time.Duration, beats float64, triggerCC, triggerKey int) *PhraseDetector {
+	return &PhraseDetector{
+		silence:    silence,
+		beats:      beats,
+		triggerCC:  triggerCC,
+		triggerKey: triggerKey,
+	}
+}
+
+// observe looks at an incoming event. It returns true if the event is a control event (the trigger), which should not be played or recorded.
+func (d *PhraseDetector) observe(ev midiio.Event, at time.Time) (control bool) {
+	typ, _ := midiio.ParseStatus(byte(ev.Status))
+	data1, data2 := midiio.ParseData(byte(ev.Data1)), midiio.ParseData(byte(ev.Data2))
+
+	switch {
+	case typ == midiio.ControlChangeStatus && int(data1) == d.triggerCC:
+		if data2 >= 64 {
+			d.triggered = true
+		}
+		return true
+	case (typ == midiio.NoteOnStatus || typ == midiio.NoteOffStatus) && int(data1) == d.triggerKey:
+		if typ == midiio.NoteOnStatus && data2 > 0 {
+			d.triggered = true
+		}
+		return true
+	case typ == midiio.NoteOnStatus && data2 > 0:
+		d.tempo.onset(at)
+	}
+	d.last = at
+	return false
+}
+
+// threshold is the length of silence that ends a phrase.
+func (d *PhraseDetector) threshold() time.Duration {
+	if d.beats > 0 {
+		if beat, ok := d.tempo.beat(); ok {
+			return time.Duration(d.beats * float64(beat))
+		}
+	}
+	return d.silence
+}
+
+// ended returns true if the trigger was played, or if there has been enough silence since the last event.
+func (d *PhraseDetector) ended(now time.Time) bool {
+	if d.triggered {
+		return true
+	}
+	return !d.last.IsZero() && now.Sub(d.last) >= d.threshold()
+}
+
+// remaining returns how much longer the silence has to last to end the phrase.
+func (d *PhraseDetector) remaining(now time.Time) time.Duration {
+	if d.last.IsZero() {
+		return d.threshold()
+	}
+	return d.threshold() - now.Sub(d.last)
+}
+
+// reset is called when the machine takes its turn.
+func (d *PhraseDetector) reset() {
+	d.triggered = false
+}
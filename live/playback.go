@@ -0,0 +1,175 @@
+package live
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chewxy/gopherconsg2018/midiio"
+	"github.com/chewxy/gopherconsg2018/model"
+	"github.com/gomidi/midi"
+	"github.com/gomidi/midi/midimessage/channel"
+	"github.com/pkg/errors"
+)
+
+// player plays the machine's response on the output.
+type player struct {
+	out     midiio.Out
+	voicing Voicing
+	onNote  func(msg model.Message, machine bool) // called for every note that starts or stops. May be nil
+	log     *slog.Logger
+
+	// the phrase that is currently being played
+	sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (p *player) Write(msg midi.Message) (nBytes int, err error) {
+	switch m := msg.(type) {
+	case channel.NoteOn:
+		raw := m.Raw()
+		err = p.out.WriteShort(int64(raw[0]), int64(raw[1]), int64(raw[2]))
+		return len(raw), err
+	case channel.NoteOff:
+		raw := m.Raw()
+		err = p.out.WriteShort(int64(raw[0]), int64(raw[1]), int64(raw[2]))
+		return len(raw), err
+	case channel.ProgramChange:
+		raw := m.Raw()
+		err = p.out.WriteShort(int64(raw[0]), int64(raw[1]), 0)
+		return len(raw), err
+	case channel.ControlChange:
+		raw := m.Raw()
+		err = p.out.WriteShort(int64(raw[0]), int64(raw[1]), int64(raw[2]))
+		return len(raw), err
+	}
+	return 0, errors.Errorf("Unable to write %v: unsupported message", msg)
+}
+
+func (p *player) note(msg model.Message) {
+	if p.onNote != nil {
+		p.onNote(msg, true)
+	}
+}
+
+// write schedules the messages to be played with the player's voicing, and returns immediately. Any phrase that is still playing is interrupted.
+func (p *player) write(msgs []model.Message) {
+	var sched schedule
+	var at time.Duration
+	for _, msg := range msgs {
+		// for debugging
+		// log.Printf("\t%v, %v, %v, %v", msg.Channel, msg.Key, msg.Velocity, msg.Duration)
+		if msg.Duration > 3000 {
+			continue // something went wrong
+		}
+		dur := time.Duration(msg.Duration) * time.Millisecond
+		if msg.Key == model.Rest {
+			at += dur
+			continue
+		}
+		ons, offs := p.voicing.notes(msg)
+		for _, on := range ons {
+			sched.add(at, on)
+		}
+		for _, off := range offs {
+			sched.add(at+dur, off)
+		}
+		at += dur
+	}
+	p.play(sched)
+}
+
+// scheduledMessage is a message that is to be played at a given time after the start of a phrase.
+type scheduledMessage struct {
+	at  time.Duration
+	msg midi.Message
+}
+
+// schedule is a list of messages to be played.
+type schedule []scheduledMessage
+
+func (s *schedule) add(at time.Duration, msg midi.Message) {
+	*s = append(*s, scheduledMessage{at, msg})
+}
+
+func (s schedule) Len() int { return len(s) }
+func (s schedule) Less(i, j int) bool {
+	if s[i].at != s[j].at {
+		return s[i].at < s[j].at
+	}
+	// NoteOffs come first so that a repeated key is not cut short
+	_, iOff := midiio.AsNoteOff(s[i].msg)
+	_, jOff := midiio.AsNoteOff(s[j].msg)
+	return iOff && !jOff
+}
+func (s schedule) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// play starts playing the schedule in the background. Any phrase that is still playing is interrupted first.
+// Playback stops at the first message that cannot be written. Notes that are sounding are stopped whenever playback stops.
+//
+// The time of each message is computed against the output device's clock from the start of the phrase,
+// so delays in one message do not push back the messages that come after it.
+func (p *player) play(sched schedule) {
+	sort.Stable(sched)
+
+	p.interrupt()
+	p.Lock()
+	stop, done := make(chan struct{}), make(chan struct{})
+	p.stop, p.done = stop, done
+	p.Unlock()
+
+	go func() {
+		defer close(done)
+		defer midiio.SilenceOnPanic(p.out)
+		sounding := make(map[midiio.NoteKey]channel.NoteOff)
+		defer func() {
+			// interrupted: don't leave any notes hanging
+			for k, off := range sounding {
+				p.Write(off)
+				p.note(model.Message{Channel: k.Channel, Key: k.Key, Velocity: 0})
+			}
+		}()
+
+		start := p.out.Now()
+		for _, sm := range sched {
+			if wait := time.Duration(start-p.out.Now())*time.Millisecond + sm.at; wait > 0 {
+				t := time.NewTimer(wait)
+				select {
+				case <-t.C:
+				case <-stop:
+					t.Stop()
+					return
+				}
+			}
+
+			switch m := sm.msg.(type) {
+			case channel.NoteOn:
+				sounding[midiio.NoteKey{Channel: m.Channel(), Key: m.Key()}] = channel.New(m.Channel()).NoteOff(m.Key())
+				p.note(model.Message{Channel: m.Channel(), Key: m.Key(), Velocity: m.Velocity()})
+			case channel.NoteOff:
+				delete(sounding, midiio.NoteKey{Channel: m.Channel(), Key: m.Key()})
+				p.note(model.Message{Channel: m.Channel(), Key: m.Key(), Velocity: 0})
+			}
+			if _, err := p.Write(sm.msg); err != nil {
+				p.log.Warn("Stopping playback", "err", err)
+				return
+			}
+		}
+	}()
+}
+
+// interrupt stops the phrase that is currently playing (if any), and waits for it to stop.
+func (p *player) interrupt() {
+	p.Lock()
+	stop, done := p.stop, p.done
+	p.stop, p.done = nil, nil
+	p.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,210 @@
+package live
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/chewxy/gopherconsg2018/midiio"
+	"github.com/chewxy/gopherconsg2018/model"
+	"github.com/gomidi/midi/smf"
+	"github.com/pkg/errors"
+)
+
+// live durations are in milliseconds, so sessions are recorded at a resolution where a tick is a millisecond
+const (
+	sessionBPM        = 120
+	sessionResolution = smf.MetricTicks(500)
+)
+
+// SessionDurationUnit is the unit of the durations of a session log. The pairs of a MIDI file are in ticks at the resolution of the file instead.
+const SessionDurationUnit = "ms"
+
+// SessionEntry is a line of the session log. It is a superset of model.JSONPair, so a session log can be used as a training dataset.
+type SessionEntry struct {
+	model.JSONPair
+	DurationUnit string    `json:"duration_unit"` // SessionDurationUnit
+	Time         time.Time `json:"time"`          // when the call started
+	Responded    time.Time `json:"responded"`     // when the response started
+	LatencyMS    float64   `json:"latency_ms"`    // how long the prediction took
+}
+
+// midiInterval is how often the session's MIDI file is rewritten while exchanges are being recorded
+const midiInterval = 10 * time.Second
+
+// Recorder records the calls and responses of a live session to a MIDI file, with the call and the response on separate tracks,
+// and logs each exchange to a JSONL file. Recording is done in the background, so that Record never blocks the loop.
+//
+// Each exchange is logged as soon as it is recorded. The MIDI file is rewritten with all the exchanges at most every midiInterval,
+// and when the recorder is closed. It is replaced at once, so a crash leaves the previous version rather than a truncated file.
+type Recorder struct {
+	start     time.Time
+	midiFile  string
+	log       *os.File
+	enc       *json.Encoder
+	phrases   []midiio.Phrase // owned by the writer
+	settings  midiio.ExportSettings
+	exchanges chan exchange
+	done      chan struct{} // closed when the writer has finished
+
+	sync.Mutex
+	closed bool
+	err    error // the first error that the writer ran into, until it is reported
+}
+
+// NewRecorder creates the files of a new session in dir. The files are named after the time the session started.
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "Unable to create session directory")
+	}
+	start := time.Now()
+	name := filepath.Join(dir, "session-"+start.Format("20060102-150405"))
+	f, err := os.Create(name + ".jsonl")
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create session log")
+	}
+
+	settings := midiio.DefaultExportSettings()
+	settings.Resolution = sessionResolution
+	settings.BPM = sessionBPM
+	settings.LeadIn = 0
+	settings.Timed = true
+	for i := range settings.Tracks {
+		settings.Tracks[i].Velocity = 0 // keep the velocities that were played
+	}
+
+	r := &Recorder{
+		start:     start,
+		midiFile:  name + ".mid",
+		log:       f,
+		enc:       json.NewEncoder(f),
+		settings:  settings,
+		exchanges: make(chan exchange, 64),
+		done:      make(chan struct{}),
+	}
+	go r.write()
+	return r, nil
+}
+
+// ticks returns the tick of the session's MIDI file at which something that happened at t starts.
+func (r *Recorder) ticks(t time.Time) uint64 {
+	if t.Before(r.start) {
+		return 0
+	}
+	return uint64(t.Sub(r.start) / time.Millisecond)
+}
+
+// exchange is a recorded call and response
+type exchange struct {
+	entry   SessionEntry
+	phrases []midiio.Phrase
+}
+
+// Record queues an exchange to be recorded, and returns immediately. Calls without a response are not recorded, as they are not pairs.
+// It returns the error that recording an earlier exchange ran into, if any, or an error if the exchange had to be dropped.
+func (r *Recorder) Record(call []model.Message, callStart time.Time, response []model.Message, responded time.Time, latency time.Duration) error {
+	x := exchange{
+		entry: SessionEntry{
+			JSONPair:     model.JSONPair{In: model.ToJSON(call), Out: model.ToJSON(response)},
+			DurationUnit: SessionDurationUnit,
+			Time:         callStart,
+			Responded:    responded,
+			LatencyMS:    float64(latency) / float64(time.Millisecond),
+		},
+		phrases: []midiio.Phrase{
+			{Role: midiio.CallRole, Msgs: call, Start: r.ticks(callStart)},
+			{Role: midiio.ResponseRole, Msgs: response, Start: r.ticks(responded)},
+		},
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if r.closed {
+		return errors.New("The session recorder is closed")
+	}
+	err := r.err
+	r.err = nil
+	if len(response) == 0 {
+		return err
+	}
+	select {
+	case r.exchanges <- x:
+	default:
+		if err == nil {
+			err = errors.New("The session recorder is falling behind. Dropped an exchange")
+		}
+	}
+	return err
+}
+
+// write records the queued exchanges until the recorder is closed.
+func (r *Recorder) write() {
+	defer close(r.done)
+	tick := time.NewTicker(midiInterval)
+	defer tick.Stop()
+	var dirty bool // there are exchanges that are not in the MIDI file yet
+	for {
+		select {
+		case x, ok := <-r.exchanges:
+			if !ok {
+				if dirty {
+					r.fail(r.writeMIDI())
+				}
+				return
+			}
+			if err := r.enc.Encode(x.entry); err != nil {
+				r.fail(errors.Wrap(err, "Unable to write session log"))
+			}
+			r.phrases = append(r.phrases, x.phrases...)
+			dirty = true
+		case <-tick.C:
+			if dirty {
+				r.fail(r.writeMIDI())
+				dirty = false
+			}
+		}
+	}
+}
+
+func (r *Recorder) writeMIDI() error {
+	if err := midiio.WriteMIDIFile(r.midiFile, r.phrases, r.settings); err != nil {
+		return errors.Wrap(err, "Unable to write session MIDI file")
+	}
+	return nil
+}
+
+// fail keeps the first error that the writer runs into.
+func (r *Recorder) fail(err error) {
+	if err == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// Close records the exchanges that are still queued, writes the MIDI file and closes the session log.
+// It returns the first error that recording ran into and that Record has not reported yet.
+func (r *Recorder) Close() error {
+	r.Lock()
+	if r.closed {
+		r.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.exchanges)
+	r.Unlock()
+
+	<-r.done
+	err := r.log.Close()
+	r.Lock()
+	defer r.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package live
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chewxy/gopherconsg2018/midiio"
+	"github.com/chewxy/gopherconsg2018/model"
+)
+
+func TestRecorder(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs := []model.Pair{
+		{In: []model.Message{note(0, 60, 400, 100), rest(0, 100), note(0, 62, 200, 90)}, Out: []model.Message{note(1, 64, 300, 80)}},
+		{In: []model.Message{note(0, 67, 500, 100)}, Out: []model.Message{note(1, 65, 250, 70), note(1, 64, 250, 70)}},
+	}
+	at := r.start.Add(time.Second)
+	for _, p := range pairs {
+		var length uint
+		for _, m := range p.In {
+			length += m.Duration
+		}
+		responded := at.Add(time.Duration(length) * time.Millisecond)
+		if err := r.Record(p.In, at, p.Out, responded, 5*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		at = responded.Add(2 * time.Second)
+	}
+	if err := r.Record(pairs[0].In, at, nil, at, 0); err != nil { // not recorded, as it is not a pair
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Record(pairs[0].In, at, pairs[0].Out, at, 0); err == nil {
+		t.Error("Expected recording after closing to fail")
+	}
+
+	logged, err := model.ReadPairsFile(r.log.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(logged, pairs) {
+		t.Errorf("Logged %v. Want %v", logged, pairs)
+	}
+	f, err := os.Open(r.log.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entry SessionEntry
+	if err := json.NewDecoder(f).Decode(&entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.DurationUnit != SessionDurationUnit || !entry.Time.Equal(r.start.Add(time.Second)) || entry.LatencyMS != 5 {
+		t.Errorf("Unexpected log entry %+v", entry)
+	}
+
+	parts, err := midiio.NewPartMap([]int{0}, []int{1}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := midiio.NewDecoder(parts)
+	if err := d.ReadFile(r.midiFile); err != nil {
+		t.Fatal(err)
+	}
+	// the silence between the first response and the second call is a rest of the response
+	want := []model.Pair{
+		{In: pairs[0].In, Out: append(pairs[0].Out, rest(1, 1700))},
+		pairs[1],
+	}
+	if recorded := d.Pairs(); !reflect.DeepEqual(recorded, want) {
+		t.Errorf("Recorded %v. Want %v", recorded, want)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("Expected the session's log and MIDI file, and no temporary files. Got %v", files)
+	}
+	for _, f := range files {
+		if fi, err := os.Stat(f); err != nil || fi.Size() == 0 {
+			t.Errorf("%v is empty", f)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package live
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/chewxy/gopherconsg2018/midiio"
+	"github.com/chewxy/gopherconsg2018/model"
+)
+
+// maxRestarts is how many times the MIDI loop is restarted after a failed prediction before the session is stopped.
+const maxRestarts = 3
+
+// deviceRetries is how many times opening the MIDI devices is retried, deviceRetryInterval apart. Devices are often still being plugged in when a session starts.
+const deviceRetries = 3
+
+var deviceRetryInterval = time.Second
+
+// Supervisor runs the parts of a live session, and decides what happens when one of them fails:
+//   - if training fails, the session carries on with the last weights that were published
+//   - if predicting fails, the MIDI loop is restarted, up to maxRestarts times
+//   - if the visuals fail, the session carries on without them until it is stopped
+//
+// Any other failure stops the session. See OpenDevices for what happens when the MIDI devices fail to open.
+type Supervisor struct {
+	Train func(context.Context) error
+	Play  func(context.Context) error
+	Show  func(context.Context) error // runs on the calling goroutine, as the visuals must run on the main thread. Nil runs without visuals
+
+	Log *slog.Logger // nil logs to the default logger
+}
+
+// logger returns the logger, or the default logger if it is nil.
+func logger(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
+
+// Run runs the session until the context is cancelled, the MIDI loop stops or the window is closed.
+// It returns the failure that stopped the session, if any.
+func (sv Supervisor) Run(ctx context.Context, cancel context.CancelFunc) error {
+	log := logger(sv.Log)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var fatal error
+	stop := func(err error) {
+		mu.Lock()
+		if fatal == nil {
+			fatal = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		var graphErr model.GraphError
+		var checkpointErr model.CheckpointError
+		switch err := sv.Train(ctx); {
+		case err == nil:
+		case errors.As(err, &graphErr), errors.As(err, &checkpointErr):
+			log.Warn("Training stopped. Carrying on with the last weights", "err", err)
+		default:
+			stop(err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer cancel() // the session is over
+		for restarts := 0; ; restarts++ {
+			err := sv.Play(ctx)
+			var graphErr model.GraphError
+			if errors.As(err, &graphErr) && restarts < maxRestarts && ctx.Err() == nil {
+				log.Warn("Restarting the MIDI loop", "err", err, "restarts", restarts+1)
+				continue
+			}
+			if err != nil {
+				stop(err)
+			}
+			return
+		}
+	}()
+
+	if sv.Show == nil {
+		<-ctx.Done()
+	} else if err := sv.Show(ctx); err != nil {
+		log.Warn("Carrying on without visuals", "err", err)
+		<-ctx.Done()
+	}
+
+	cancel()
+	wg.Wait()
+	return fatal
+}
+
+// OpenDevices opens the MIDI devices of a session with open (normally midiio.Open), and decides what happens when they fail to open:
+//   - opening is retried, up to deviceRetries times
+//   - if the output still fails to open, the session carries on without output
+//   - if the input still fails to open, the error is returned, as there is nothing to respond to
+//
+// Errors other than a midiio.DeviceError, such as an unknown backend, are returned at once.
+func OpenDevices(ctx context.Context, cfg midiio.Config, open func(midiio.Config) (*midiio.Pipe, error), l *slog.Logger) (*midiio.Pipe, error) {
+	log := logger(l)
+	for retries := 0; ; retries++ {
+		p, err := open(cfg)
+		var deviceErr midiio.DeviceError
+		if err == nil || !errors.As(err, &deviceErr) {
+			return p, err
+		}
+		if retries == deviceRetries {
+			if deviceErr.Input || cfg.NoOutput {
+				return nil, err
+			}
+			log.Warn("Carrying on without MIDI output", "err", err)
+			cfg.NoOutput = true
+			return open(cfg)
+		}
+		log.Warn("Unable to open MIDI devices. Retrying", "err", err, "retries", retries+1)
+		select {
+		case <-time.After(deviceRetryInterval):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
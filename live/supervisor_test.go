@@ -0,0 +1,91 @@
+package live
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/chewxy/gopherconsg2018/midiio"
+	"github.com/chewxy/gopherconsg2018/model"
+)
+
+func TestOpenDevices(t *testing.T) {
+	defer func(interval time.Duration) { deviceRetryInterval = interval }(deviceRetryInterval)
+	deviceRetryInterval = time.Millisecond
+
+	outputErr := midiio.DeviceError{Device: "synth", Err: fmt.Errorf("not found")}
+	inputErr := midiio.DeviceError{Device: "keyboard", Input: true, Err: fmt.Errorf("not found")}
+	tests := []struct {
+		name     string
+		failures int   // how many times opening fails
+		err      error // what it fails with
+		noOutput bool  // opening fails unless the output is discarded
+
+		wantCalls    int
+		wantErr      bool
+		wantNoOutput bool
+	}{
+		{name: "opens", wantCalls: 1},
+		{name: "retries", failures: 2, err: outputErr, wantCalls: 3},
+		{name: "retries wrapped errors", failures: 2, err: fmt.Errorf("opening: %w", inputErr), wantCalls: 3},
+		{name: "carries on without output", err: outputErr, noOutput: true, wantCalls: deviceRetries + 2, wantNoOutput: true},
+		{name: "stops without input", failures: 100, err: inputErr, wantCalls: deviceRetries + 1, wantErr: true},
+		{name: "other errors are not retried", failures: 100, err: fmt.Errorf("unknown backend"), wantCalls: 1, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int
+			var opened midiio.Config
+			open := func(cfg midiio.Config) (*midiio.Pipe, error) {
+				calls++
+				if calls <= tc.failures || (tc.noOutput && !cfg.NoOutput) {
+					return nil, tc.err
+				}
+				opened = cfg
+				return midiio.Open(cfg)
+			}
+			p, err := OpenDevices(context.Background(), midiio.Config{Backend: "fake"}, open, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Got error %v. Expected an error: %t", err, tc.wantErr)
+			}
+			if calls != tc.wantCalls {
+				t.Errorf("Opened %d times. Want %d", calls, tc.wantCalls)
+			}
+			if err != nil {
+				return
+			}
+			defer p.Close()
+			if opened.NoOutput != tc.wantNoOutput {
+				t.Errorf("Opened without output: %t. Want %t", opened.NoOutput, tc.wantNoOutput)
+			}
+			if _, ok := p.Out.(*midiio.Discard); ok != tc.wantNoOutput {
+				t.Errorf("The output is a %T", p.Out)
+			}
+		})
+	}
+}
+
+func TestSupervisorRestartsOnWrappedGraphErrors(t *testing.T) {
+	var plays int
+	sv := Supervisor{
+		Train: func(ctx context.Context) error { return fmt.Errorf("epoch 3: %w", model.CheckpointError{}) },
+		Play: func(ctx context.Context) error {
+			if plays++; plays < 3 {
+				return fmt.Errorf("responding: %w", model.GraphError{})
+			}
+			return nil
+		},
+		Log: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := sv.Run(ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	if plays != 3 {
+		t.Errorf("Played %d times. Expected the loop to be restarted twice", plays)
+	}
+}
@@ -0,0 +1,138 @@
+package live
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"runtime"
+	"time"
+
+	"github.com/chewxy/gopherconsg2018/metrics"
+	"github.com/chewxy/gopherconsg2018/midiio"
+	"github.com/chewxy/gopherconsg2018/model"
+	pb "gopkg.in/cheggaaa/pb.v1"
+)
+
+// DefaultCheckpoint is the file that the model is checkpointed to.
+const DefaultCheckpoint = "CHECKPOINT.bin"
+
+// Trainer trains the model in the background of a live session, and publishes its weights whenever it is checkpointed, so that the loop can pick them up.
+type Trainer struct {
+	Model      *model.Seq2Seq
+	Models     *model.Holder // the loop's models. May be nil, in which case nothing is published
+	Pairs      []model.Pair
+	Validation []model.Pair // held out pairs that the validation loss is computed on after every epoch. May be empty
+	Iters      int
+	Checkpoint string     // file to checkpoint to. Empty uses DefaultCheckpoint
+	Out        midiio.Out // the player is told that training is done with a couple of notes. May be nil
+
+	Log   *slog.Logger // the model logs here too. Nil logs to the default logger
+	Quiet bool         // don't show a progress bar
+}
+
+// Run trains the model for the given number of iterations. The trainer's model is replaced by a fresh copy at every checkpoint, to reduce memory pressure.
+// When the context is cancelled, training stops after the current iteration and a checkpoint is saved.
+func (t *Trainer) Run(ctx context.Context) error {
+	checkpoint := t.Checkpoint
+	if checkpoint == "" {
+		checkpoint = DefaultCheckpoint
+	}
+	s2s := t.Model
+	if t.Log != nil {
+		s2s.SetLogger(t.Log)
+	}
+	solver := model.NewSolver()
+	bar := pb.New(t.Iters)
+	if !t.Quiet {
+		bar.Start()
+	}
+
+	var i int
+	for i = 0; i < t.Iters && ctx.Err() == nil; i++ {
+		start := time.Now()
+		stats, err := s2s.TrainEpoch(i, solver, t.Pairs)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		metrics.Epoch.Set(int64(i))
+		metrics.IterationsPerSec.Set(1 / time.Since(start).Seconds())
+		if err == nil {
+			metrics.Cost.Set(float64(stats.Cost))
+			metrics.GradientNorm.Set(float64(stats.GradientNorm))
+		}
+		if len(t.Validation) > 0 {
+			loss, err := s2s.Loss(t.Validation)
+			if err != nil {
+				return err
+			}
+			metrics.ValidationLoss.Set(float64(loss))
+		}
+		bar.Increment()
+		if i%100 == 0 && i > 0 {
+			if err := s2s.SaveFile(checkpoint); err != nil {
+				return err
+			}
+			fresh := s2s.Blank()
+			s2s.Release()
+			runtime.GC() // reduce memory pressure
+			if err := fresh.LoadFile(checkpoint); err != nil {
+				return err // GC pressure reduction failure
+			}
+			logger(t.Log).Debug("Checkpointed", "iter", i, "file", checkpoint)
+			s2s, t.Model = fresh, fresh
+			t.publish(s2s)
+		}
+	}
+	if !t.Quiet {
+		bar.Finish()
+	}
+
+	stopped := ctx.Err() != nil
+	if i > 0 && (t.Iters > 50 || stopped) { // an untrained model never overwrites the checkpoint
+		if err := s2s.SaveFile(checkpoint); err != nil {
+			return err
+		}
+	}
+	if stopped {
+		return nil
+	}
+	t.publish(s2s)
+	if t.Out != nil {
+		t.notify(ctx, s2s)
+	}
+	return nil
+}
+
+// notify tells the player that the neural network is ready, by playing the first and last keys of its vocabulary for a second.
+// Failed writes are logged, as training is done anyway.
+func (t *Trainer) notify(ctx context.Context, s2s *model.Seq2Seq) {
+	keys, _ := s2s.Vocabulary()
+	if len(keys) == 0 {
+		return
+	}
+	var err error
+	write := func(status, key, vel int64) {
+		if werr := t.Out.WriteShort(status, key, vel); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	lo, hi := int64(keys[0]), int64(keys[len(keys)-1])
+	write(0x90, lo, 100)
+	write(0x90, hi, 100)
+	select {
+	case <-time.After(1 * time.Second):
+	case <-ctx.Done():
+	}
+	write(0x80, lo, 0)
+	write(0x80, hi, 0)
+	if err != nil {
+		logger(t.Log).Warn("Unable to play the ready notes", "err", err)
+	}
+}
+
+// publish hands the model's weights to the loop, if there is one.
+func (t *Trainer) publish(s2s *model.Seq2Seq) {
+	if t.Models != nil {
+		t.Models.Publish(s2s.Snapshot())
+	}
+}
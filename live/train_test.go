@@ -0,0 +1,93 @@
+package live
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/chewxy/gopherconsg2018/midiio"
+	"github.com/chewxy/gopherconsg2018/model"
+)
+
+// newTestTrainer makes a trainer of an untrained model with the given keys, that checkpoints to a temporary file.
+func newTestTrainer(t *testing.T, keys []byte, iters int) *Trainer {
+	pairs := []model.Pair{{
+		In:  []model.Message{{Key: 60, Duration: 100}, {Key: 62, Duration: 200}},
+		Out: []model.Message{{Channel: 1, Key: 64, Duration: 100}},
+	}}
+	return &Trainer{
+		Model:      model.New(model.Config{HiddenSize: 8, EmbeddingSize: 4}, keys, []uint{100, 200}),
+		Pairs:      pairs,
+		Iters:      iters,
+		Checkpoint: filepath.Join(t.TempDir(), "checkpoint.bin"),
+		Log:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Quiet:      true,
+	}
+}
+
+func TestTrainerWithoutHolder(t *testing.T) {
+	tr := newTestTrainer(t, []byte{60, 62, 64}, 2)
+	if err := tr.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrainerCancelledBeforeTraining(t *testing.T) {
+	tr := newTestTrainer(t, []byte{60, 62, 64}, 100)
+	const old = "the last trained weights"
+	if err := os.WriteFile(tr.Checkpoint, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := tr.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(tr.Checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != old {
+		t.Error("Expected the checkpoint not to be overwritten with untrained weights")
+	}
+}
+
+func TestTrainerNotifies(t *testing.T) {
+	f := midiio.NewFake()
+	tr := newTestTrainer(t, []byte{60, 62, 64}, 1)
+	tr.Out = f
+	if err := tr.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var got [][3]int64
+	for _, ev := range f.Written() {
+		got = append(got, [3]int64{ev.Status, ev.Data1, ev.Data2})
+	}
+	want := [][3]int64{{0x90, 60, 100}, {0x90, 64, 100}, {0x80, 60, 0}, {0x80, 64, 0}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrote %v. Want %v", got, want)
+	}
+
+	// the notes can't be played, but training is done anyway
+	f.Close()
+	if err := tr.Run(context.Background()); err != nil {
+		t.Errorf("Expected failed notes to be logged. Got %v", err)
+	}
+}
+
+func TestTrainerEmptyVocabulary(t *testing.T) {
+	f := midiio.NewFake()
+	tr := newTestTrainer(t, nil, 1)
+	tr.Pairs = nil
+	tr.Out = f
+	if err := tr.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if written := f.Written(); len(written) != 0 {
+		t.Errorf("Expected no notes. Got %v", written)
+	}
+}
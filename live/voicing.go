@@ -0,0 +1,124 @@
+package live
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/chewxy/gopherconsg2018/model"
+	"github.com/gomidi/midi/midimessage/channel"
+	"github.com/pkg/errors"
+)
+
+// Voice is an output channel that plays the response.
+type Voice struct {
+	Channel byte
+	Program int     // program to select before playing. -1 leaves the program alone
+	Scale   float64 // velocity scale
+}
+
+// Voicing describes how the response is played: on which channels, how loud, and with which doublings and harmonies.
+type Voicing struct {
+	Voices    []Voice // no voices plays each note on its own channel
+	Velocity  byte    // base velocity of notes that don't have one
+	Octaves   []int   // octave doublings, e.g. -1 doubles an octave below
+	Intervals []int   // harmony intervals in semitones, e.g. 4 and 7 for a major triad
+}
+
+// ParseVoices parses a comma separated list of voices in the form channel[:program[:scale]].
+func ParseVoices(list string) (retVal []Voice, err error) {
+	for _, f := range strings.Split(list, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		parts := strings.Split(f, ":")
+		if len(parts) > 3 {
+			return nil, errors.Errorf("Unable to parse voice %q. Expected channel[:program[:scale]]", f)
+		}
+
+		v := Voice{Program: -1, Scale: 1}
+		var ch int
+		if ch, err = strconv.Atoi(parts[0]); err != nil || ch < 0 || ch > 15 {
+			return nil, errors.Errorf("Voice %q: %q is not a valid channel", f, parts[0])
+		}
+		v.Channel = byte(ch)
+		if len(parts) > 1 && parts[1] != "" {
+			if v.Program, err = strconv.Atoi(parts[1]); err != nil || v.Program < 0 || v.Program > 127 {
+				return nil, errors.Errorf("Voice %q: %q is not a valid program", f, parts[1])
+			}
+		}
+		if len(parts) > 2 && parts[2] != "" {
+			if v.Scale, err = strconv.ParseFloat(parts[2], 64); err != nil || v.Scale < 0 {
+				return nil, errors.Errorf("Voice %q: %q is not a valid velocity scale", f, parts[2])
+			}
+		}
+		retVal = append(retVal, v)
+	}
+	return retVal, nil
+}
+
+// clampVelocity clamps a velocity to 1-127. 0 is not allowed because a NoteOn with a velocity of 0 is a NoteOff.
+func clampVelocity(v float64) byte {
+	switch {
+	case v < 1:
+		return 1
+	case v > 127:
+		return 127
+	}
+	return byte(v + 0.5)
+}
+
+// programChanges returns the program changes of the voices that select a program.
+func (v Voicing) programChanges() (retVal []channel.ProgramChange) {
+	for _, vc := range v.Voices {
+		if vc.Program >= 0 {
+			retVal = append(retVal, channel.New(vc.Channel).ProgramChange(byte(vc.Program)))
+		}
+	}
+	return retVal
+}
+
+// keys returns the key and all its doublings and harmonies that are in the MIDI range.
+func (v Voicing) keys(key byte) []byte {
+	retVal := []byte{key}
+	add := func(k int) {
+		if k < 0 || k > 127 {
+			return
+		}
+		for _, existing := range retVal {
+			if existing == byte(k) {
+				return
+			}
+		}
+		retVal = append(retVal, byte(k))
+	}
+	for _, o := range v.Octaves {
+		add(int(key) + 12*o)
+	}
+	for _, i := range v.Intervals {
+		add(int(key) + i)
+	}
+	return retVal
+}
+
+// notes returns the NoteOns and NoteOffs that play the message.
+func (v Voicing) notes(msg model.Message) (ons []channel.NoteOn, offs []channel.NoteOff) {
+	base := msg.Velocity
+	if base == 0 {
+		base = v.Velocity
+	}
+	voices := v.Voices
+	if len(voices) == 0 {
+		voices = []Voice{{Channel: msg.Channel, Program: -1, Scale: 1}}
+	}
+
+	for _, vc := range voices {
+		ch := channel.New(vc.Channel)
+		vel := clampVelocity(float64(base) * vc.Scale)
+		for _, k := range v.keys(msg.Key) {
+			ons = append(ons, ch.NoteOn(k, vel))
+			offs = append(offs, ch.NoteOff(k))
+		}
+	}
+	return ons, offs
+}
@@ -0,0 +1,67 @@
+package live
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/chewxy/gopherconsg2018/model"
+)
+
+func TestParseVoices(t *testing.T) {
+	tests := []struct {
+		list string
+		want []Voice
+		ok   bool
+	}{
+		{"", nil, true},
+		{"1", []Voice{{1, -1, 1}}, true},
+		{" 1, 2:5 ,,3:7:0.5", []Voice{{1, -1, 1}, {2, 5, 1}, {3, 7, 0.5}}, true},
+		{"0::1.5,15:127", []Voice{{0, -1, 1.5}, {15, 127, 1}}, true},
+		{"1:2:3:4", nil, false},
+		{"16", nil, false},
+		{"-1", nil, false},
+		{"a", nil, false},
+		{":1", nil, false},
+		{"1:128", nil, false},
+		{"1:x", nil, false},
+		{"1::-1", nil, false},
+		{"1::loud", nil, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.list, func(t *testing.T) {
+			got, err := ParseVoices(tc.list)
+			if (err == nil) != tc.ok {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Parsed %v. Want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// The default -voices and -velocity play the response like the original demo did: on channels 1-3, with velocities 106, 110 and 106.
+func TestDefaultVoicing(t *testing.T) {
+	voices, err := ParseVoices("1::1.06,2::1.1,3::1.06")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := Voicing{Voices: voices, Velocity: 100}
+	if changes := v.programChanges(); len(changes) != 0 {
+		t.Errorf("Expected no program changes. Got %v", changes)
+	}
+
+	ons, offs := v.notes(model.Message{Channel: 0, Key: 60, Duration: 100})
+	if len(ons) != 3 || len(offs) != 3 {
+		t.Fatalf("Expected 3 NoteOns and NoteOffs. Got %v and %v", ons, offs)
+	}
+	want := []struct{ channel, velocity uint8 }{{1, 106}, {2, 110}, {3, 106}}
+	for i, w := range want {
+		if ons[i].Channel() != w.channel || ons[i].Key() != 60 || ons[i].Velocity() != w.velocity {
+			t.Errorf("NoteOn %d is %v. Want key 60 on channel %d with velocity %d", i, ons[i], w.channel, w.velocity)
+		}
+		if offs[i].Channel() != w.channel || offs[i].Key() != 60 {
+			t.Errorf("NoteOff %d is %v. Want key 60 on channel %d", i, offs[i], w.channel)
+		}
+	}
+}
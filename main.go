@@ -1,283 +1,623 @@
+// Command gopherconsg2018 trains a sequence to sequence model on call and response phrases, and plays call and response with a performer over MIDI.
 package main
 
 import (
+	"context"
 	"flag"
-	"io"
-	"log"
-	"runtime"
-	"sync/atomic"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/gomidi/midi"
-	"github.com/gomidi/midi/midimessage/channel"
-	"github.com/gomidi/midi/smf/smfreader"
-	"github.com/rakyll/portmidi"
-	pb "gopkg.in/cheggaaa/pb.v1"
-	"gorgonia.org/gorgonia"
+	"github.com/chewxy/gopherconsg2018/live"
+	"github.com/chewxy/gopherconsg2018/metrics"
+	"github.com/chewxy/gopherconsg2018/midiio"
+	"github.com/chewxy/gopherconsg2018/model"
+	"github.com/chewxy/gopherconsg2018/server"
+	"github.com/chewxy/gopherconsg2018/stream"
+	"github.com/chewxy/gopherconsg2018/viz"
+	"github.com/pkg/errors"
 )
 
-const (
-	embeddingSize = 20
-	maxOut        = 11
+var trainiter = flag.Int("iter", 0, "How many iterations to train")
+var trainingData = flag.String("train", "simplediag.mid", "What is the MIDI file (or .jsonl dataset) to use for training? See -call and -response for which channels are used")
+var callParts = flag.String("call", "0", "Comma separated list of channels (or tracks, with -bytrack) that make up the call")
+var responseParts = flag.String("response", "1", "Comma separated list of channels (or tracks, with -bytrack) that make up the response")
+var byTrack = flag.Bool("bytrack", false, "Interpret -call and -response as track numbers instead of channels")
+var segmentGap = flag.Float64("segmentgap", 0, "Split a single performance into phrases at rests of at least this many beats. The -call and -response channels are treated as one performance")
+var segmentBars = flag.Int("segmentbars", 0, "Split a single performance into phrases of this many bars. The -call and -response channels are treated as one performance")
+
+// MIDI backend
+var backend = flag.String("backend", "portmidi", "MIDI backend: portmidi, fake (in-memory, no hardware) or replay (input replayed from -replay, output discarded)")
+var inDevice = flag.String("in", "", "Name (or part of the name, or ID) of the MIDI input device. Empty uses the default device")
+var outDevice = flag.String("out", "", "Name (or part of the name, or ID) of the MIDI output device. Empty uses the default device")
+var replayFile = flag.String("replay", "", "MIDI file to replay as input for the replay backend")
+var replaySpeed = flag.Float64("replayspeed", 1, "Playback speed of the replay backend")
+var eventsAddr = flag.String("events", "", "Address to stream the session's notes, phrases and predictions on, as a WebSocket at ws://addr/events (e.g. localhost:8081). Empty disables streaming")
+var eventsOrigins = flag.String("eventsorigins", "", "Comma separated origins that pages may connect to the event stream from, besides the stream's own (e.g. http://localhost:8000). null allows pages opened from a file, * allows any page")
+var metricsAddr = flag.String("metrics", "", "Address to serve training and performance metrics on, as JSON at http://addr/debug/vars (e.g. localhost:6060). Empty disables metrics")
+var window = flag.Bool("window", true, "Show the notes in an OpenGL window")
+var recordDir = flag.String("record", "", "Directory to record live sessions to, as a MIDI file and a JSONL log of the exchanges (e.g. sessions). Empty disables recording")
+
+// end of phrase detection
+var silence = flag.Int("silence", 2000, "How many milliseconds of silence end the player's phrase")
+var silenceBeats = flag.Float64("silencebeats", 0, "If > 0, end the player's phrase after this many beats of silence at the estimated tempo instead")
+var triggerCC = flag.Int("triggercc", -1, "Control change that hands over to the machine immediately when pressed (e.g. 64 for the sustain pedal). -1 disables")
+var triggerKey = flag.Int("triggerkey", -1, "Key that hands over to the machine immediately when played. -1 disables")
+
+// performer panic
+var panicCC = flag.Int("paniccc", -1, "Control change that stops all notes and the machine's response when pressed. -1 disables")
+var panicKey = flag.Int("panickey", -1, "Key that stops all notes and the machine's response when played. -1 disables")
+
+// export
+var bpm = flag.Int("bpm", 120, "Tempo of exported MIDI files")
+var callProgram = flag.Int("callprogram", 68, "General MIDI program of the call in exported MIDI files")
+var responseProgram = flag.Int("responseprogram", 57, "General MIDI program of the response in exported MIDI files")
+
+// stats and lint
+var outlierDuration = flag.Int("outlier", 3000, "Durations longer than this many ticks are counted as outliers by stats")
+var maxUnmatched = flag.Int("maxunmatched", -1, "stats fails if there are more unmatched NoteOn/NoteOff than this. -1 disables the check")
+var maxZeroLength = flag.Int("maxzero", -1, "stats fails if there are more zero length notes than this. -1 disables the check")
+var maxOutliers = flag.Int("maxoutliers", -1, "stats fails if there are more outlier durations than this. -1 disables the check")
+var maxEmpty = flag.Int("maxempty", -1, "stats fails if there are more pairs with an empty input or output than this. -1 disables the check")
+
+// augmentation
+var seed = flag.Int64("seed", 0, "Random seed for the augmentation pipeline and the validation split. 0 uses the current time")
+var validate = flag.Float64("validate", 0, "Fraction of the training pairs to hold out (before augmentation) to compute the validation loss on")
+var selectedPairs = flag.String("select", "", "Comma separated list of pair indices to train on. Empty means all pairs")
+var oversampled = flag.String("oversample", "", "Comma separated list of pair indices to oversample")
+var oversampleBy = flag.Int("oversampleby", 5, "How many extra copies of each oversampled pair to add")
+var jitter = flag.Int("jitter", 0, "How many copies of each pair with one input duration randomly replaced to add")
+var transposeBy = flag.Int("transpose", 0, "Add a copy of each pair transposed by up to this many semitones")
+var tempoBy = flag.Float64("tempo", 0, "Add a copy of each pair with the tempo scaled by up to this fraction (e.g. 0.1)")
+var dropout = flag.Float64("dropout", 0, "Add a copy of each pair with input notes dropped with this probability")
+
+// response voicing
+var voices = flag.String("voices", "1::1.06,2::1.1,3::1.06", "Comma separated list of channel[:program[:velocity scale]] that play the response. Empty plays each note on its own channel")
+var baseVelocity = flag.Int("velocity", 100, "Velocity of response notes before scaling")
+var octaves = flag.String("octaves", "", "Comma separated list of octaves to double the response in (e.g. -1,1)")
+var harmony = flag.String("harmony", "", "Comma separated list of intervals in semitones to harmonize the response with (e.g. 4,7)")
+
+// logging
+var logLevel = flag.String("loglevel", "info", "Log level: debug, info, warn or error")
+var logJSON = flag.Bool("logjson", false, "Log as JSON instead of text")
+var perf = flag.Bool("perf", false, "Performance mode: only log warnings and errors, and don't show the training progress bar")
+
+// serve
+var addr = flag.String("addr", "localhost:8080", "Address that serve listens on")
+var workers = flag.Int("workers", 2, "How many requests serve predicts at the same time. Each one holds a copy of the model")
+
+// makeVoicing makes the response voicing from the flags.
+func makeVoicing() (v live.Voicing, err error) {
+	if *baseVelocity < 1 || *baseVelocity > 127 {
+		return v, errors.Errorf("Velocity %d is out of range. Expected 1-127", *baseVelocity)
+	}
+	v.Velocity = byte(*baseVelocity)
+	if v.Voices, err = live.ParseVoices(*voices); err != nil {
+		return v, err
+	}
+	if *octaves != "" {
+		if v.Octaves, err = parseInts(*octaves); err != nil {
+			return v, err
+		}
+	}
+	if *harmony != "" {
+		if v.Intervals, err = parseInts(*harmony); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
 
-	// gradient update stuff
-	l2reg     = 0.000001
-	learnrate = 0.01
-	clipVal   = 5.0
-)
+// makePipeline builds the augmentation pipeline from the flags. Each step has its own random source so toggling one step does not change the others.
+func makePipeline() (p model.Pipeline, err error) {
+	s := *seed
+	if s == 0 {
+		s = time.Now().UnixNano()
+	}
+	rng := func(step int64) *rand.Rand { return rand.New(rand.NewSource(s + step)) }
 
-var trainiter = flag.Int("iter", 0, "How many iterations to train")
-var toCondition = flag.Bool("condition", false, "Condition the NN to #2?")
-var trainingData = flag.String("train", "simplediag.mid", "What is the MIDI file to use for training? Channel 0 is the input,  Channel 1 and above are responses")
+	if *selectedPairs != "" {
+		var indices []int
+		if indices, err = parseInts(*selectedPairs); err != nil {
+			return nil, err
+		}
+		p = append(p, model.Select{Indices: indices})
+	}
+	if *oversampled != "" {
+		var indices []int
+		if indices, err = parseInts(*oversampled); err != nil {
+			return nil, err
+		}
+		p = append(p, model.Oversample{Indices: indices, Times: *oversampleBy})
+	}
+	if *jitter > 0 {
+		p = append(p, model.DurationJitter{Copies: *jitter, Rng: rng(1)})
+	}
+	if *transposeBy > 0 {
+		p = append(p, model.Transposition{Max: *transposeBy, Rng: rng(2)})
+	}
+	if *tempoBy > 0 {
+		p = append(p, model.TempoScale{Max: *tempoBy, Rng: rng(3)})
+	}
+	if *dropout > 0 {
+		p = append(p, model.NoteDropout{P: *dropout, Rng: rng(4)})
+	}
+	return p, nil
+}
 
-type bridge struct {
-	stream *portmidi.Stream
+// makePartMap makes the part map of the call and response channels (or tracks) from the flags.
+func makePartMap() (midiio.PartMap, error) {
+	call, err := parseInts(*callParts)
+	if err != nil {
+		return midiio.PartMap{}, err
+	}
+	response, err := parseInts(*responseParts)
+	if err != nil {
+		return midiio.PartMap{}, err
+	}
+	return midiio.NewPartMap(call, response, *byTrack)
 }
 
-func (b *bridge) Write(msg midi.Message) (nBytes int, err error) {
-	switch m := msg.(type) {
-	case channel.NoteOn:
-		raw := m.Raw()
-		err = b.stream.WriteShort(int64(raw[0]), int64(raw[1]), int64(raw[2]))
-		return len(raw), err
-	case channel.NoteOff:
-		raw := m.Raw()
-		err = b.stream.WriteShort(int64(raw[0]), int64(raw[1]), int64(raw[2]))
-		return len(raw), err
-	}
-	panic("Unreachable")
+// readTrainingData reads the training pairs from the training data, which is either a MIDI file or a JSONL dataset.
+// The decoder is nil for JSONL datasets.
+func readTrainingData() (pairs []model.Pair, d *midiio.Decoder, err error) {
+	if model.IsDataset(*trainingData) {
+		pairs, err = model.ReadPairsFile(*trainingData)
+		return pairs, nil, err
+	}
+
+	parts, err := makePartMap()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	d = midiio.NewDecoder(parts)
+	if err = d.ReadFile(*trainingData); err != nil {
+		return nil, nil, err
+	}
+	if seg := (midiio.Segmenter{Gap: *segmentGap, Bars: *segmentBars}); seg.Enabled() {
+		pairs = d.SegmentedPairs(seg)
+	} else {
+		pairs = d.Pairs()
+	}
+	return pairs, d, nil
 }
 
-func (b *bridge) write(msgs []message, repeat bool) {
-	for _, msg := range msgs {
-		// for debugging
-		// log.Printf("\t%v, %v, %v, %v", msg.channel, msg.key, msg.velocity, msg.duration)
-		if msg.duration > 3000 {
-			continue // something went wrong
-		}
-		if msg.key == 255 {
-			time.Sleep(time.Duration(msg.duration) * time.Millisecond)
-			continue
-		}
-		if repeat {
-			ch1 := channel.New(msg.channel)
-			ch2 := channel.New(msg.channel + 1)
-			ch3 := channel.New(msg.channel + 2)
-
-			updateCells(message{key: msg.key, velocity: 100})
-			nOn1 := ch1.NoteOn(msg.key, msg.velocity+106)
-			nOn2 := ch2.NoteOn(msg.key, msg.velocity+110)
-			nOn3 := ch3.NoteOn(msg.key, msg.velocity+106)
-			b.Write(nOn1)
-			b.Write(nOn2)
-			b.Write(nOn3)
-			time.Sleep(time.Duration(msg.duration) * time.Millisecond)
-
-			updateCells(message{key: msg.key, velocity: 0})
-			nOff1 := ch1.NoteOff(msg.key)
-			nOff2 := ch2.NoteOff(msg.key)
-			nOff3 := ch3.NoteOff(msg.key)
-			b.Write(nOff1)
-			b.Write(nOff2)
-			b.Write(nOff3)
-		} else {
-			ch := channel.New(msg.channel)
-
-			updateCells(message{key: msg.key, velocity: 100})
-			nOn := ch.NoteOn(msg.key, msg.velocity)
-			b.Write(nOn)
-
-			time.Sleep(time.Duration(msg.duration) * time.Millisecond)
-
-			updateCells(message{key: msg.key, velocity: 0})
-			nOff := ch.NoteOff(msg.key)
-			b.Write(nOff)
+// dataset is what the model is trained on, and the vocabulary that it is made with.
+type dataset struct {
+	pairs      []model.Pair // augmented
+	validation []model.Pair
+	keys       []byte
+	durations  []uint
+	export     midiio.ExportSettings // at the resolution of the training data
+}
+
+// loadPairs reads the training pairs, holds out the validation pairs (unless split is false) and augments the rest.
+func loadPairs(split bool) (ds dataset, err error) {
+	aug, err := makePipeline()
+	if err != nil {
+		return ds, err
+	}
+	pairs, d, err := readTrainingData()
+	if err != nil {
+		return ds, err
+	}
+	ds.export = midiio.DefaultExportSettings()
+	if d != nil {
+		ds.export = d.ExportSettings()
+	}
+	if *validate < 0 || *validate >= 1 {
+		return ds, errors.Errorf("Validation fraction %v is out of range. Expected 0 up to 1", *validate)
+	}
+	ds.keys, ds.durations = vocabulary(pairs)
+	if *validate > 0 && split {
+		s := *seed
+		if s == 0 {
+			s = time.Now().UnixNano()
 		}
+		pairs, ds.validation = model.Split(pairs, *validate, rand.New(rand.NewSource(s)))
 	}
+
+	_, durations := model.Vocabulary(pairs)
+	ds.pairs = aug.Augment(pairs, durations)
+	return ds, nil
 }
 
-func setupMIDIPipe() (in, out *portmidi.Stream) {
-	portmidi.Initialize()
-	log.Printf("Devices %v", portmidi.CountDevices())
-	log.Printf("Info %v", portmidi.Info(0))
-	log.Printf("Info %v", portmidi.Info(1))
-	var err error
+// vocabulary returns the keys and durations that the model is made with. They come from the pairs as they were read, before the split and the
+// augmentation (which are random), so that the model has the same shape on every run and can load its checkpoint.
+// Transposing is the only augmentation that makes up keys, so the keys are widened by the transposition range.
+func vocabulary(pairs []model.Pair) (keys []byte, durations []uint) {
+	keys, durations = model.Vocabulary(pairs)
+	if *transposeBy > 0 {
+		keys = model.Transposition{Max: *transposeBy}.Keys(keys)
+	}
+	return keys, durations
+}
 
-	if in, err = portmidi.NewInputStream(0, 1024); err != nil {
-		log.Fatal(err)
+// serveMetrics serves the metrics if an address was given. The returned server is nil otherwise.
+func serveMetrics() (*http.Server, error) {
+	if *metricsAddr == "" {
+		return nil, nil
+	}
+	ln, err := net.Listen("tcp", *metricsAddr)
+	if err != nil {
+		return nil, err
 	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", metrics.Handler())
+	hs := &http.Server{Handler: mux}
+	go hs.Serve(ln)
+	slog.Info("Serving metrics", "url", fmt.Sprintf("http://%v/debug/vars", ln.Addr()))
+	return hs, nil
+}
 
-	if out, err = portmidi.NewOutputStream(1, 1024, 0); err != nil {
-		log.Fatal(err)
+// stats prints statistics about the training data, and returns false if any of the lint thresholds are exceeded.
+func stats() (ok bool, err error) {
+	pairs, d, err := readTrainingData()
+	if err != nil {
+		return false, err
+	}
+	s := model.CollectStats(pairs, uint(*outlierDuration))
+	if d != nil {
+		s.UnmatchedOn, s.UnmatchedOff = d.Unmatched()
 	}
-	return in, out
+	s.Report(os.Stdout)
+
+	problems := s.Lint(model.LintThresholds{
+		Unmatched:  *maxUnmatched,
+		ZeroLength: *maxZeroLength,
+		Outliers:   *maxOutliers,
+		Empty:      *maxEmpty,
+	})
+	for _, p := range problems {
+		slog.Warn("Lint", "problem", p)
+	}
+	return len(problems) == 0, nil
 }
 
-func MIDILoop(in, out *portmidi.Stream, s2s *seq2seq) {
-	defer in.Close()
-	defer out.Close()
+// dump writes the training pairs to the given file as JSONL. An empty file name writes to stdout.
+func dump(pairs []model.Pair, filename string) error {
+	if filename == "" {
+		return model.WritePairs(os.Stdout, pairs)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err = model.WritePairs(f, pairs); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
 
-	ch := in.Listen()
-	var silence int64
-	var timesince portmidi.Timestamp
-	var msgs []message
-	var cur message
+// export writes the training pairs to a MIDI file, one pair after another.
+func export(pairs []model.Pair, settings midiio.ExportSettings, filename string) error {
+	if filename == "" {
+		return errors.New("export needs a file name")
+	}
+	if *bpm < 1 {
+		return errors.Errorf("Tempo %d is out of range. Expected at least 1 BPM", *bpm)
+	}
+	for _, p := range []int{*callProgram, *responseProgram} {
+		if p < 0 || p > 127 {
+			return errors.Errorf("Program %d is out of range. Expected 0-127", p)
+		}
+	}
+	settings.BPM = uint32(*bpm)
+	settings.Tracks[0].Program = byte(*callProgram)
+	settings.Tracks[1].Program = byte(*responseProgram)
 
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-	go func() {
-		for range ticker.C {
-			atomic.AddInt64(&silence, 1)
+	var phrases []midiio.Phrase
+	for _, p := range pairs {
+		phrases = append(phrases, midiio.PairPhrases(p)...)
+	}
+	return midiio.WriteMIDIFile(filename, phrases, settings)
+}
 
-		}
-	}()
+// serve answers prediction requests over HTTP with the checkpointed model until it receives SIGINT or SIGTERM.
+// The vocabulary comes from the training data, so the model has the same shape as the one that was trained.
+func serve(ds dataset) error {
+	if len(ds.pairs) == 0 {
+		return errors.Errorf("No training pairs found in %v", *trainingData)
+	}
+	parts, err := makePartMap()
+	if err != nil {
+		return err
+	}
+	s2s := model.New(model.DefaultConfig, ds.keys, ds.durations)
+	if err := s2s.LoadFile(live.DefaultCheckpoint); err != nil {
+		return errors.Wrap(err, "serve needs a trained model")
+	}
+	srv, err := server.New(s2s, *workers, parts)
+	if err != nil {
+		return err
+	}
+	ms, err := serveMetrics()
+	if err != nil {
+		return err
+	}
+	if ms != nil {
+		defer ms.Close()
+	}
 
-	b := bridge{out}
+	hs := &http.Server{Addr: *addr, Handler: srv}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(sigs)
+		sig := <-sigs
+		slog.Info("Shutting down", "signal", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hs.Shutdown(ctx)
+	}()
 
-	for {
-		select {
-		case ev := <-ch:
-			// log.Printf("RECEIVED %v %v %v", ev, byte(ev.Data1), ev.Data1)
-			// input from user
-			_, playChan := parseStatus(byte(ev.Status))
-			key := parseData(byte(ev.Data1))
-			vel := parseData(byte(ev.Data2))
-
-			updateCells(message{key: key, velocity: vel})
-			if vel == 0 {
-				cur.duration = uint(ev.Timestamp - timesince)
-				msgs = append(msgs, cur)
-				cur = message{
-					key:     255,
-					channel: playChan,
-				}
-			} else {
-				if timesince != 0 && cur.key == 255 {
-					// encode rests
-					cur.duration = uint(ev.Timestamp - timesince)
-					msgs = append(msgs, cur)
-				}
-				cur.key = key
-				cur.channel = playChan
-				cur.velocity = vel
-			}
-			timesince = ev.Timestamp
-
-			out.WriteShort(ev.Status, ev.Data1, ev.Data2)
-			atomic.StoreInt64(&silence, 0)
-		default:
-			ts := atomic.LoadInt64(&silence)
-			if ts > 2 && len(msgs) > 0 {
-				// play output from computer
-				pred, err := s2s.predict(msgs)
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				b.write(pred, true)
-				msgs = msgs[:0]
-				atomic.StoreInt64(&silence, 0)
-			}
-		}
+	slog.Info("Serving", "url", fmt.Sprintf("http://%v/predict", *addr))
+	if err := hs.ListenAndServe(); err != http.ErrServerClosed {
+		return err
 	}
+	<-done
+	return nil
 }
 
-func trainingLoop(s2s *seq2seq, iters int, pairs []trainingPair, embeddingSize, hiddenSize int, keys []byte, durations []uint, mOut *portmidi.Stream) {
-	solver := gorgonia.NewRMSPropSolver(gorgonia.WithLearnRate(learnrate), gorgonia.WithL2Reg(l2reg), gorgonia.WithClip(clipVal))
-	bar := pb.StartNew(iters)
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [flags] [command]
 
-	for i := 0; i < iters; i++ {
-		if err := train(s2s, i, solver, pairs[:]); err != nil && err != io.EOF {
-			log.Fatalf("Training Failure %+v", err)
-		}
-		bar.Increment()
-		if i%100 == 0 && i > 0 {
-			s2s.g.UnbindAll()
-
-			s2s = NewS2S(embeddingSize, hiddenSize, keys, durations)
-			runtime.GC() // reduce memory pressure
-			if err := s2s.load(); err != nil {
-				log.Fatalf("GC Pressure Reduction Failure", err)
-			}
-		}
+Commands:
+  (none)        train if needed, then play call and response over MIDI
+  dump [file]   write the (augmented) training pairs as JSONL to file, or stdout. -validate is ignored, so no pairs are held out
+  export file   write the (augmented) training pairs to a MIDI file
+  devices       list the MIDI devices that can be used with -in and -out
+  stats         print statistics about the training data. Exits with 1 if any of the -max* thresholds are exceeded
+  serve         answer phrases posted to http://-addr/predict with the trained model, without MIDI devices
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// setupLogging makes the logger from the flags the default logger.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return errors.Errorf("Unknown log level %q. Expected debug, info, warn or error", *logLevel)
 	}
-	if iters > 50 {
-		if err := s2s.checkpoint(); err != nil {
-			log.Fatalf("Failed to save checkpoint after training", err)
-		}
+	if *perf && level < slog.LevelWarn {
+		level = slog.LevelWarn
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if *logJSON {
+		h = slog.NewJSONHandler(os.Stderr, opts)
 	}
-	bar.Finish()
+	slog.SetDefault(slog.New(h))
+	return nil
+}
 
-	// notify user that the neural network is ready
-	mOut.WriteShort(0x90, int64(keys[0]), 100)
-	mOut.WriteShort(0x90, int64(keys[len(keys)-1]), 100)
-	time.Sleep(1 * time.Second)
-	mOut.WriteShort(0x80, int64(keys[0]), 0)
-	mOut.WriteShort(0x80, int64(keys[len(keys)-1]), 0)
+// fatal logs the error and exits.
+func fatal(err error) {
+	slog.Error("Failed", "err", err)
+	os.Exit(1)
 }
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
-	mIn, mOut := setupMIDIPipe()
-
-	d := new(decoder)
-	if err := smfreader.ReadFile(*trainingData, d.readMIDI); err != nil {
-		log.Fatal(err)
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		os.Exit(2)
 	}
 
-	pairs, keys, durations := d.makeTrainingPairs(*toCondition)
-	log.Printf("%d Pairs | %v", len(pairs), pairs[0].in)
-	log.Printf("Keys %v", keys)
-	log.Printf("Durations %v", durations)
+	switch flag.Arg(0) {
+	case "", "dump", "export", "serve":
+	case "devices":
+		if err := midiio.ListDevices(os.Stdout); err != nil {
+			fatal(err)
+		}
+		return
+	case "stats":
+		ok, err := stats()
+		if err != nil {
+			fatal(err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
 
-	start := keys[0]
-	for i := 0; i < len(keys); i++ {
-		key := keys[i]
+	ds, err := loadPairs(flag.Arg(0) != "dump") // dumps have all the pairs
+	if err != nil {
+		fatal(err)
+	}
+	pairs, validation, keys, durations := ds.pairs, ds.validation, ds.keys, ds.durations
+	switch flag.Arg(0) {
+	case "dump":
+		if err := dump(pairs, flag.Arg(1)); err != nil {
+			fatal(err)
+		}
+		return
+	case "export":
+		if err := export(pairs, ds.export, flag.Arg(1)); err != nil {
+			fatal(err)
+		}
+		return
+	case "serve":
+		if err := serve(ds); err != nil {
+			fatal(err)
+		}
+		return
+	}
 
-		loc := int(key - start)
-		if loc <= 1 {
-			if _, ok := cellLookup[key]; ok {
-				continue
-			}
-			y := loc / cols
-			x := loc % cols
-
-			cellLookup[key] = struct{ x, y int }{x, y}
-		} else {
-			// fill in the missing keya so that when we press on them in the demo, accidentally, they light up
-			for j := loc; j >= 0; j-- {
-				key2 := key - byte(j)
-				if _, ok := cellLookup[key2]; ok {
-					continue
-				}
-				loc2 := int(key2 - start)
-				y := loc2 / cols
-				x := loc2 % cols
-				cellLookup[key2] = struct{ x, y int }{x, y}
-			}
+	if len(pairs) == 0 {
+		fatal(errors.Errorf("No training pairs found in %v", *trainingData))
+	}
+	v, err := makeVoicing()
+	if err != nil {
+		fatal(err)
+	}
+	var rec *live.Recorder
+	if *recordDir != "" {
+		if rec, err = live.NewRecorder(*recordDir); err != nil {
+			fatal(err)
 		}
 	}
+	pipe, err := live.OpenDevices(context.Background(), midiio.Config{
+		Backend:     *backend,
+		In:          *inDevice,
+		Out:         *outDevice,
+		Replay:      *replayFile,
+		ReplaySpeed: *replaySpeed,
+	}, midiio.Open, slog.With("component", "session"))
+	if err != nil {
+		fatal(err)
+	}
+	mOut := midiio.NewNoteGuard(metrics.CountOut(pipe.Out)) // the trainer, the loop and the playback all write to the output
 
-	// log.Printf("CellLookup %v", cellLookup)
+	slog.Info("Loaded training data", "pairs", len(pairs), "validation", len(validation), "keys", len(keys), "durations", len(durations))
+	slog.Debug("Vocabulary", "first", pairs[0].In, "keys", keys, "durations", durations)
+	viz.Layout(keys)
 
 	// fwd upper bound, good as a guideline but otherwise useless
-	// hiddenSize := len(pairs) / (2 * (2*embeddingSize + len(keys) + len(durations)))
+	// hiddenSize := len(pairs) / (2 * (2*model.EmbeddingSize + len(keys) + len(durations)))
 	// if hiddenSize == 0 {
 	// 	hiddenSize = 100
 	// }
-	hiddenSize := 100
-
-	s2s := NewS2S(embeddingSize, hiddenSize, keys, durations)
+	s2s := model.New(model.DefaultConfig, keys, durations)
 
 	// try to load
 	var iters = *trainiter
-	if err := s2s.load(); err != nil {
-		log.Printf("Loading failed %v", err)
-		iters = 10000
+	if err := s2s.LoadFile(live.DefaultCheckpoint); err != nil {
+		if iters == 0 {
+			iters = 10000
+		}
+		slog.Warn("Loading failed. Training from scratch", "iters", iters, "err", err)
 	}
 
-	go trainingLoop(s2s, iters, pairs, embeddingSize, hiddenSize, keys, durations, mOut)
-	go MIDILoop(mIn, mOut, s2s)
-	mainGL()
+	// the loop predicts with its own model, so that it never touches the graph that is being trained.
+	// It starts with the weights that were loaded, and picks up new ones from the holder.
+	models := new(model.Holder)
+	models.Publish(s2s.Snapshot())
 
+	// SIGINT, SIGTERM, closing the window or a failure that the supervisor can't handle stop everything
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	caught := make(chan os.Signal, 1)
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(sigs)
+		select {
+		case sig := <-sigs:
+			slog.Info("Shutting down", "signal", sig)
+			caught <- sig
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var hub *stream.Hub
+	var events *http.Server
+	if *eventsAddr != "" {
+		ln, err := net.Listen("tcp", *eventsAddr)
+		if err != nil {
+			fatal(err)
+		}
+		hub = stream.NewHub()
+		hub.Origins = parseList(*eventsOrigins)
+		mux := http.NewServeMux()
+		mux.Handle("/events", hub)
+		events = &http.Server{Handler: mux}
+		go events.Serve(ln)
+		slog.Info("Streaming events", "url", fmt.Sprintf("ws://%v/events", ln.Addr()))
+	}
+
+	ms, err := serveMetrics()
+	if err != nil {
+		fatal(err)
+	}
+	trainer := &live.Trainer{Model: s2s, Models: models, Pairs: pairs, Validation: validation, Iters: iters, Out: mOut,
+		Log: slog.With("component", "train"), Quiet: *perf}
+	playing := s2s.Blank()
+	playing.SetLogger(slog.With("component", "loop"))
+	loop := &live.Loop{
+		In:       pipe.In,
+		Out:      mOut,
+		Model:    playing,
+		Models:   models,
+		Detector: live.NewPhraseDetector(time.Duration(*silence)*time.Millisecond, *silenceBeats, *triggerCC, *triggerKey),
+		Panic:    live.PanicControl{CC: *panicCC, Key: *panicKey},
+		Voicing:  v,
+		Recorder: rec,
+		OnNote: func(msg model.Message, machine bool) {
+			viz.Update(msg)
+			if hub != nil {
+				hub.Note(msg, machine)
+			}
+		},
+		Log: slog.With("component", "loop"),
+	}
+	if hub != nil {
+		loop.OnPhrase = hub.Phrase
+		loop.OnPredict = hub.Predict
+	}
+	sv := live.Supervisor{
+		Train: func(ctx context.Context) error {
+			defer midiio.SilenceOnPanic(mOut)
+			return trainer.Run(ctx)
+		},
+		Play: func(ctx context.Context) error {
+			defer midiio.SilenceOnPanic(mOut)
+			return loop.Run(ctx)
+		},
+		Log: slog.With("component", "session"),
+	}
+	if *window {
+		viz.SetLogger(slog.With("component", "viz"))
+		sv.Show = func(ctx context.Context) error {
+			defer midiio.SilenceOnPanic(mOut)
+			return viz.Run(ctx)
+		}
+	}
+	err = sv.Run(ctx, cancel)
+
+	if serr := midiio.StopAllNotes(mOut); serr != nil {
+		slog.Warn("Unable to silence the output", "err", serr)
+	}
+	if rec != nil {
+		if rerr := rec.Close(); rerr != nil {
+			slog.Warn("Unable to record the session", "err", rerr)
+		}
+	}
+	pipe.Close()
+	if hub != nil {
+		hub.Close()
+		events.Close()
+	}
+	if ms != nil {
+		ms.Close()
+	}
+
+	select {
+	case sig := <-caught:
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	default:
+	}
+	if err != nil {
+		slog.Error("Session failed", "err", err)
+		slog.Debug("Session failed", "trace", fmt.Sprintf("%+v", err))
+		os.Exit(1)
+	}
 }
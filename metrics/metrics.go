@@ -0,0 +1,156 @@
+// Package metrics exports the metrics of training and of live sessions with expvar. They are served as JSON at /debug/vars by Handler.
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/chewxy/gopherconsg2018/midiio"
+)
+
+// training
+var (
+	Epoch            = expvar.NewInt("train_epoch")
+	Cost             = expvar.NewFloat("train_cost")      // average cost of the last epoch
+	ValidationLoss   = expvar.NewFloat("validation_loss") // average cost of the held out pairs after the last epoch
+	GradientNorm     = expvar.NewFloat("gradient_norm")   // average gradient norm of the last epoch
+	IterationsPerSec = expvar.NewFloat("iterations_per_sec")
+)
+
+// live sessions and serving
+var (
+	PredictLatency = NewSummary("predict_latency_ms")
+	CallLength     = NewSummary("call_length") // in messages, including rests
+	ResponseLength = NewSummary("response_length")
+	MIDIIn         = NewRate("midi_events_in")
+	MIDIOut        = NewRate("midi_events_out")
+)
+
+// Handler serves all the metrics (and the memory statistics that expvar exports) as JSON.
+func Handler() http.Handler { return expvar.Handler() }
+
+// Summary summarizes observations: how many there were, their mean, min, max and the last one.
+type Summary struct {
+	sync.Mutex
+	count         int64
+	sum, min, max float64
+	last          float64
+}
+
+// NewSummary creates a summary and publishes it with the given name.
+func NewSummary(name string) *Summary {
+	s := new(Summary)
+	expvar.Publish(name, s)
+	return s
+}
+
+// Observe adds an observation.
+func (s *Summary) Observe(v float64) {
+	s.Lock()
+	defer s.Unlock()
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	if s.count == 0 || v > s.max {
+		s.max = v
+	}
+	s.count++
+	s.sum += v
+	s.last = v
+}
+
+// ObserveDuration adds a duration as an observation in milliseconds.
+func (s *Summary) ObserveDuration(d time.Duration) {
+	s.Observe(float64(d) / float64(time.Millisecond))
+}
+
+func (s *Summary) String() string {
+	s.Lock()
+	defer s.Unlock()
+	var mean float64
+	if s.count > 0 {
+		mean = s.sum / float64(s.count)
+	}
+	b, _ := json.Marshal(struct {
+		Count int64   `json:"count"`
+		Mean  float64 `json:"mean"`
+		Min   float64 `json:"min"`
+		Max   float64 `json:"max"`
+		Last  float64 `json:"last"`
+	}{s.count, mean, s.min, s.max, s.last})
+	return string(b)
+}
+
+// rateWindow is how many seconds the rate of a Rate is averaged over
+const rateWindow = 10
+
+// Rate counts events, and how many there were per second over the last few seconds.
+type Rate struct {
+	sync.Mutex
+	total   int64
+	buckets [rateWindow]int64
+	seconds [rateWindow]int64 // the second that each bucket counts
+}
+
+// NewRate creates a rate and publishes it with the given name.
+func NewRate(name string) *Rate {
+	r := new(Rate)
+	expvar.Publish(name, r)
+	return r
+}
+
+// Add counts n events.
+func (r *Rate) Add(n int64) {
+	now := time.Now().Unix()
+	i := now % rateWindow
+	r.Lock()
+	defer r.Unlock()
+	if r.seconds[i] != now {
+		r.seconds[i], r.buckets[i] = now, 0
+	}
+	r.buckets[i] += n
+	r.total += n
+}
+
+// PerSec returns the average number of events per second over the last complete seconds.
+func (r *Rate) PerSec() float64 {
+	now := time.Now().Unix()
+	r.Lock()
+	defer r.Unlock()
+	var n int64
+	for i, sec := range r.seconds {
+		if sec < now && sec >= now-rateWindow {
+			n += r.buckets[i]
+		}
+	}
+	return float64(n) / rateWindow
+}
+
+func (r *Rate) String() string {
+	perSec := r.PerSec()
+	r.Lock()
+	total := r.total
+	r.Unlock()
+	b, _ := json.Marshal(struct {
+		Total  int64   `json:"total"`
+		PerSec float64 `json:"per_sec"`
+	}{total, perSec})
+	return string(b)
+}
+
+// countingOut counts the messages that are written to an output.
+type countingOut struct {
+	midiio.Out
+	rate *Rate
+}
+
+// CountOut counts the messages that are written to the output in MIDIOut.
+func CountOut(out midiio.Out) midiio.Out { return countingOut{out, MIDIOut} }
+
+func (c countingOut) WriteShort(status, data1, data2 int64) error {
+	c.rate.Add(1)
+	return c.Out.WriteShort(status, data1, data2)
+}
@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chewxy/gopherconsg2018/midiio"
+)
+
+func TestSummary(t *testing.T) {
+	s := new(Summary)
+	if got, want := s.String(), `{"count":0,"mean":0,"min":0,"max":0,"last":0}`; got != want {
+		t.Errorf("Empty summary is %v. Want %v", got, want)
+	}
+	for _, v := range []float64{3, -1, 7} {
+		s.Observe(v)
+	}
+	s.ObserveDuration(3500 * time.Microsecond)
+	if got, want := s.String(), `{"count":4,"mean":3.125,"min":-1,"max":7,"last":3.5}`; got != want {
+		t.Errorf("Summary is %v. Want %v", got, want)
+	}
+}
+
+func TestRate(t *testing.T) {
+	r := new(Rate)
+	r.Add(3)
+	r.Add(2)
+	var got struct {
+		Total  int64   `json:"total"`
+		PerSec float64 `json:"per_sec"`
+	}
+	if err := json.Unmarshal([]byte(r.String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Total != 5 {
+		t.Errorf("Total is %d. Want 5", got.Total)
+	}
+
+	// pretend that events were counted in the previous seconds, in the current second, and long ago.
+	// Only the previous seconds are counted. It is retried if the second ends during the check.
+	for {
+		r := new(Rate)
+		now := time.Now().Unix()
+		for ago, n := range map[int64]int64{0: 100, 1: 10, 2: 30, rateWindow + 3: 1000} {
+			i := (now - ago) % rateWindow
+			r.seconds[i], r.buckets[i] = now-ago, n
+		}
+		perSec := r.PerSec()
+		if time.Now().Unix() != now {
+			continue
+		}
+		if perSec != 4 {
+			t.Errorf("Rate is %v per second. Want 4", perSec)
+		}
+		break
+	}
+}
+
+func TestCountOut(t *testing.T) {
+	f := midiio.NewFake()
+	before := MIDIOut.total
+	out := CountOut(f)
+	for i := int64(0); i < 3; i++ {
+		if err := out.WriteShort(0x90, 60+i, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(f.Written()) != 3 {
+		t.Errorf("Wrote %v. Want 3 messages", f.Written())
+	}
+	if counted := MIDIOut.total - before; counted != 3 {
+		t.Errorf("Counted %d messages. Want 3", counted)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	Epoch.Set(12)
+	PredictLatency.Observe(20)
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("Served %q: %v", w.Body.String(), err)
+	}
+	for _, name := range []string{"train_epoch", "train_cost", "validation_loss", "gradient_norm", "iterations_per_sec", "predict_latency_ms", "call_length", "response_length", "midi_events_in", "midi_events_out"} {
+		if _, ok := vars[name]; !ok {
+			t.Errorf("%v is not served", name)
+		}
+	}
+	if string(vars["train_epoch"]) != "12" {
+		t.Errorf("train_epoch is %s. Want 12", vars["train_epoch"])
+	}
+	var latency struct{ Count int64 }
+	if err := json.Unmarshal(vars["predict_latency_ms"], &latency); err != nil || latency.Count == 0 {
+		t.Errorf("predict_latency_ms is %s. Want at least one observation", vars["predict_latency_ms"])
+	}
+}
@@ -0,0 +1,463 @@
+package midiio
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gomidi/midi/midimessage/meta"
+	"github.com/gomidi/midi/smf"
+	"github.com/gomidi/midi/smf/smftrack"
+	"github.com/pkg/errors"
+	"github.com/rakyll/portmidi"
+)
+
+// Event is a short MIDI message. The timestamp is in milliseconds.
+type Event struct {
+	Timestamp int64
+	Status    int64
+	Data1     int64
+	Data2     int64
+}
+
+// In is a source of MIDI events, such as a MIDI keyboard. The channel that Listen returns is closed when the input is closed, or runs out of events.
+type In interface {
+	Listen() <-chan Event
+	Close() error
+}
+
+// Out is a MIDI destination, such as a synthesizer.
+type Out interface {
+	WriteShort(status, data1, data2 int64) error
+	Now() int64 // the device's clock, in milliseconds
+	Close() error
+}
+
+// PortmidiOut is an Out that writes to a portmidi output stream.
+type PortmidiOut struct {
+	*portmidi.Stream
+}
+
+func (out *PortmidiOut) Now() int64 { return int64(portmidi.Time()) }
+
+// pollInterval is how often a portmidi input stream is polled for events
+const pollInterval = 10 * time.Millisecond
+
+// portmidiIn is an In that reads from a portmidi input stream.
+// It polls the stream itself instead of using the stream's Listen, which can't be stopped.
+type portmidiIn struct {
+	*portmidi.Stream
+	listen  sync.Once
+	close   sync.Once
+	ch      chan Event
+	done    chan struct{} // closed to stop polling
+	stopped chan struct{} // closed when polling has stopped
+}
+
+func newPortmidiIn(s *portmidi.Stream) *portmidiIn {
+	return &portmidiIn{
+		Stream:  s,
+		ch:      make(chan Event, 1024),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (in *portmidiIn) Listen() <-chan Event {
+	in.listen.Do(func() { go in.poll() })
+	return in.ch
+}
+
+func (in *portmidiIn) poll() {
+	defer close(in.stopped)
+	defer close(in.ch)
+	tick := time.NewTicker(pollInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-in.done:
+			return
+		}
+		events, err := in.Stream.Read(1024)
+		if err != nil {
+			continue
+		}
+		for _, ev := range events {
+			select {
+			case in.ch <- Event{Timestamp: int64(ev.Timestamp), Status: ev.Status, Data1: ev.Data1, Data2: ev.Data2}:
+			case <-in.done:
+				return
+			}
+		}
+	}
+}
+
+// Close stops polling, closes the channel of events and then the stream.
+func (in *portmidiIn) Close() (err error) {
+	in.close.Do(func() {
+		close(in.done)
+		in.listen.Do(func() { // never listened to
+			close(in.ch)
+			close(in.stopped)
+		})
+		<-in.stopped
+		err = in.Stream.Close()
+	})
+	return err
+}
+
+// FindDevice finds a portmidi device by name. Exact (case insensitive) matches are preferred over substring matches.
+// A number is treated as a device ID, and an empty name is the default device.
+func FindDevice(name string, input bool) (portmidi.DeviceID, error) {
+	dir := "output"
+	if input {
+		dir = "input"
+	}
+	usable := func(info *portmidi.DeviceInfo) bool {
+		return info != nil && ((input && info.IsInputAvailable) || (!input && info.IsOutputAvailable))
+	}
+
+	if name == "" {
+		id := portmidi.DefaultOutputDeviceID()
+		if input {
+			id = portmidi.DefaultInputDeviceID()
+		}
+		if id < 0 || !usable(portmidi.Info(id)) {
+			return -1, errors.Errorf("There is no default %v device", dir)
+		}
+		return id, nil
+	}
+
+	if n, err := strconv.Atoi(name); err == nil {
+		id := portmidi.DeviceID(n)
+		if n < 0 || n >= portmidi.CountDevices() || !usable(portmidi.Info(id)) {
+			return -1, errors.Errorf("Device %d is not a MIDI %v device. Use the devices command to list the devices", n, dir)
+		}
+		return id, nil
+	}
+
+	lower := strings.ToLower(name)
+	found := portmidi.DeviceID(-1)
+	for i := 0; i < portmidi.CountDevices(); i++ {
+		id := portmidi.DeviceID(i)
+		info := portmidi.Info(id)
+		if !usable(info) {
+			continue
+		}
+		devName := strings.ToLower(info.Name)
+		if devName == lower {
+			return id, nil
+		}
+		if found < 0 && strings.Contains(devName, lower) {
+			found = id
+		}
+	}
+	if found < 0 {
+		return -1, errors.Errorf("No MIDI %v device matches %q. Use the devices command to list the devices", dir, name)
+	}
+	return found, nil
+}
+
+// ListDevices writes a table of all the portmidi devices and their capabilities.
+func ListDevices(w io.Writer) error {
+	if err := portmidi.Initialize(); err != nil {
+		return errors.Wrap(err, "Unable to initialize portmidi")
+	}
+	defer portmidi.Terminate()
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tName\tInterface\tInput\tOutput\tOpened")
+	for i := 0; i < portmidi.CountDevices(); i++ {
+		id := portmidi.DeviceID(i)
+		info := portmidi.Info(id)
+		if info == nil {
+			continue
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%t\t%t\t%t\n", id, info.Name, info.Interface, info.IsInputAvailable, info.IsOutputAvailable, info.IsOpened)
+	}
+	return tw.Flush()
+}
+
+// Fake is an in-memory MIDI device. Events that are sent to it are received by listeners, and everything that is written to it is recorded.
+// It is both an In and an Out.
+type Fake struct {
+	sync.Mutex
+	start   time.Time
+	written []Event
+	closed  bool
+
+	sending sync.Mutex // held while sending, so that the channel is not closed during a send
+	ch      chan Event
+	ended   bool // the channel is closed
+}
+
+// NewFake creates a fake device.
+func NewFake() *Fake {
+	return &Fake{
+		start: time.Now(),
+		ch:    make(chan Event, 1024),
+	}
+}
+
+func (f *Fake) Now() int64 { return int64(time.Since(f.start) / time.Millisecond) }
+
+// Send sends an event to the listeners, as if it was played on the device. Events that are sent after the device is closed are dropped.
+func (f *Fake) Send(status, data1, data2 int64) {
+	f.sending.Lock()
+	defer f.sending.Unlock()
+	if !f.ended {
+		f.ch <- Event{f.Now(), status, data1, data2}
+	}
+}
+
+func (f *Fake) Listen() <-chan Event { return f.ch }
+
+func (f *Fake) WriteShort(status, data1, data2 int64) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.closed {
+		return errors.New("Device is closed")
+	}
+	f.written = append(f.written, Event{f.Now(), status, data1, data2})
+	return nil
+}
+
+// Written returns a copy of all the events that were written to the device.
+func (f *Fake) Written() []Event {
+	f.Lock()
+	defer f.Unlock()
+	retVal := make([]Event, len(f.written))
+	copy(retVal, f.written)
+	return retVal
+}
+
+// Close closes the device: the channel of events is closed, and writes fail. It may be called more than once.
+func (f *Fake) Close() error {
+	f.Lock()
+	f.closed = true
+	f.Unlock()
+
+	f.sending.Lock()
+	defer f.sending.Unlock()
+	if !f.ended {
+		f.ended = true
+		close(f.ch)
+	}
+	return nil
+}
+
+// Discard is an Out that discards everything that is written to it.
+type Discard struct {
+	start time.Time
+}
+
+// NewDiscard creates an output that discards everything.
+func NewDiscard() *Discard { return &Discard{start: time.Now()} }
+
+func (d *Discard) WriteShort(status, data1, data2 int64) error { return nil }
+func (d *Discard) Now() int64                                  { return int64(time.Since(d.start) / time.Millisecond) }
+func (d *Discard) Close() error                                { return nil }
+
+// Replay is an In that plays back the channel messages of a MIDI file in real time (scaled by speed).
+// The channel of events is closed when the whole file has been played.
+type Replay struct {
+	events []Event
+	speed  float64
+	listen sync.Once
+	close  sync.Once
+	ch     chan Event
+	done   chan struct{}
+}
+
+// NewReplay reads a MIDI file for replaying. The tempo is the first tempo in the file, or 120 BPM if there is none.
+func NewReplay(filename string, speed float64) (*Replay, error) {
+	if !(speed > 0) {
+		return nil, errors.Errorf("Replay speed %v is out of range. Expected above 0", speed)
+	}
+	var tracks []*smftrack.Track
+	var resolution smf.MetricTicks
+	var err error
+	read := func(rd smf.Reader) {
+		var ok bool
+		if resolution, ok = rd.Header().TimeFormat.(smf.MetricTicks); !ok {
+			err = errors.Errorf("%v: only metric time formats are supported", filename)
+			return
+		}
+		tracks, err = smftrack.SMF1{}.ReadFrom(rd)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if rerr := readSMF(f, read); rerr != nil {
+		return nil, rerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var bpm uint32
+	var all smftrack.Events
+	for _, t := range tracks {
+		t.EachEvent(func(e smftrack.Event) {
+			if tempo, ok := e.Message.(meta.Tempo); ok && bpm == 0 {
+				bpm = tempo.BPM()
+			}
+			all = append(all, e)
+		})
+	}
+	if bpm == 0 {
+		bpm = 120
+	}
+	sort.Stable(all)
+
+	r := &Replay{
+		speed: speed,
+		ch:    make(chan Event, 1024),
+		done:  make(chan struct{}),
+	}
+	for _, e := range all {
+		if _, ok := e.Message.(channeler); !ok {
+			continue
+		}
+		raw := e.Message.Raw()
+		if len(raw) < 2 {
+			continue
+		}
+		ev := Event{
+			Timestamp: int64(resolution.Duration(bpm, uint32(e.AbsTicks)) / time.Millisecond),
+			Status:    int64(raw[0]),
+			Data1:     int64(raw[1]),
+		}
+		if len(raw) > 2 {
+			ev.Data2 = int64(raw[2])
+		}
+		r.events = append(r.events, ev)
+	}
+	return r, nil
+}
+
+func (r *Replay) Listen() <-chan Event {
+	r.listen.Do(func() { go r.play() })
+	return r.ch
+}
+
+func (r *Replay) play() {
+	defer close(r.ch)
+	start := time.Now()
+	for _, ev := range r.events {
+		at := time.Duration(float64(ev.Timestamp)*float64(time.Millisecond)/r.speed) - time.Since(start)
+		select {
+		case <-time.After(at):
+		case <-r.done:
+			return
+		}
+		ev.Timestamp = int64(time.Since(start) / time.Millisecond)
+		select {
+		case r.ch <- ev:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// Close stops the replay and closes the channel of events. It may be called more than once, from any goroutine.
+func (r *Replay) Close() error {
+	r.close.Do(func() {
+		close(r.done)
+		r.listen.Do(func() { close(r.ch) }) // never listened to
+	})
+	return nil
+}
+
+// Config selects the MIDI backend and its devices.
+type Config struct {
+	Backend     string  // portmidi, fake (in-memory, no hardware) or replay (input replayed from a MIDI file, output discarded)
+	In, Out     string  // portmidi device names. See FindDevice
+	Replay      string  // MIDI file to replay as input for the replay backend
+	ReplaySpeed float64 // playback speed of the replay backend
+	NoOutput    bool    // discard the output instead of opening a device
+}
+
+// Pipe is the input and output of a MIDI backend.
+type Pipe struct {
+	In  In
+	Out Out
+
+	portmidi bool
+}
+
+// Open opens the input and output of the MIDI backend.
+func Open(cfg Config) (*Pipe, error) {
+	switch cfg.Backend {
+	case "fake":
+		f := NewFake()
+		if cfg.NoOutput {
+			return &Pipe{In: f, Out: NewDiscard()}, nil
+		}
+		return &Pipe{In: f, Out: f}, nil
+	case "replay":
+		r, err := NewReplay(cfg.Replay, cfg.ReplaySpeed)
+		if err != nil {
+			return nil, DeviceError{Device: cfg.Replay, Input: true, Err: err}
+		}
+		return &Pipe{In: r, Out: NewDiscard()}, nil
+	case "portmidi":
+	default:
+		return nil, errors.Errorf("Unknown MIDI backend %q", cfg.Backend)
+	}
+
+	if err := portmidi.Initialize(); err != nil {
+		return nil, errors.Wrap(err, "Unable to initialize portmidi")
+	}
+	fail := func(device string, input bool, err error) (*Pipe, error) {
+		portmidi.Terminate()
+		return nil, DeviceError{Device: device, Input: input, Err: err}
+	}
+	inID, err := FindDevice(cfg.In, true)
+	if err != nil {
+		return fail(cfg.In, true, err)
+	}
+	var outID portmidi.DeviceID
+	if !cfg.NoOutput {
+		if outID, err = FindDevice(cfg.Out, false); err != nil {
+			return fail(cfg.Out, false, err)
+		}
+	}
+	i, err := portmidi.NewInputStream(inID, 1024)
+	if err != nil {
+		return fail(cfg.In, true, err)
+	}
+	if cfg.NoOutput {
+		slog.Info("Opened MIDI devices", "input", portmidi.Info(inID).Name, "output", "none")
+		return &Pipe{In: newPortmidiIn(i), Out: NewDiscard(), portmidi: true}, nil
+	}
+	o, err := portmidi.NewOutputStream(outID, 1024, 0)
+	if err != nil {
+		i.Close()
+		return fail(cfg.Out, false, err)
+	}
+	slog.Info("Opened MIDI devices", "input", portmidi.Info(inID).Name, "output", portmidi.Info(outID).Name)
+	return &Pipe{In: newPortmidiIn(i), Out: &PortmidiOut{Stream: o}, portmidi: true}, nil
+}
+
+// Close closes the input and the output, and shuts down the backend.
+func (p *Pipe) Close() error {
+	err := p.In.Close()
+	if oerr := p.Out.Close(); err == nil {
+		err = oerr
+	}
+	if p.portmidi {
+		portmidi.Terminate()
+	}
+	return err
+}
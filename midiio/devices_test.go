@@ -0,0 +1,138 @@
+package midiio
+
+import (
+	"math"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chewxy/gopherconsg2018/model"
+)
+
+// drain reads events until the channel is closed, and fails if it isn't closed in time.
+func drain(t *testing.T, ch <-chan Event, timeout time.Duration) (retVal []Event) {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return retVal
+			}
+			retVal = append(retVal, ev)
+		case <-deadline:
+			t.Fatalf("The channel was not closed after %v", timeout)
+		}
+	}
+}
+
+func TestFake(t *testing.T) {
+	f := NewFake()
+	f.Send(0x90, 60, 100)
+	if err := f.WriteShort(0x80, 60, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	f.Send(0x90, 62, 100) // dropped
+
+	evs := drain(t, f.Listen(), time.Second)
+	if len(evs) != 1 || evs[0].Status != 0x90 || evs[0].Data1 != 60 {
+		t.Errorf("Got %v. Expected the NoteOn that was sent before closing", evs)
+	}
+	if w := f.Written(); len(w) != 1 || w[0].Status != 0x80 {
+		t.Errorf("Written: got %v", w)
+	}
+	if err := f.WriteShort(0x90, 60, 100); err == nil {
+		t.Error("Expected writing to a closed device to fail")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "replay.mid")
+	settings := DefaultExportSettings()
+	settings.Resolution = 480
+	settings.LeadIn = 0
+	phrases := []Phrase{{Role: CallRole, Msgs: []model.Message{{Key: 60, Duration: 240}, {Key: 62, Duration: 240}}}}
+	if err := WriteMIDIFile(filename, phrases, settings); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReplay(filename, 4) // 0.5s at 120 BPM, played in 125ms
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var keys []int64
+	for _, ev := range drain(t, r.Listen(), 2*time.Second) {
+		if typ, _ := ParseStatus(byte(ev.Status)); typ == NoteOnStatus && ev.Data2 > 0 {
+			keys = append(keys, ev.Data1)
+		}
+	}
+	if len(keys) != 2 || keys[0] != 60 || keys[1] != 62 {
+		t.Errorf("Replayed NoteOns of %v. Expected 60 and 62", keys)
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "replay.mid")
+	phrases := []Phrase{{Role: CallRole, Msgs: []model.Message{{Key: 60, Duration: 480}}}}
+	if err := WriteMIDIFile(filename, phrases, DefaultExportSettings()); err != nil {
+		t.Fatal(err)
+	}
+	for _, speed := range []float64{0, -1, math.NaN()} {
+		if _, err := NewReplay(filename, speed); err == nil {
+			t.Errorf("Speed %v: expected an error", speed)
+		}
+	}
+}
+
+func TestReplayBackendDiscardsOutput(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "replay.mid")
+	phrases := []Phrase{{Role: CallRole, Msgs: []model.Message{{Key: 60, Duration: 480}}}}
+	if err := WriteMIDIFile(filename, phrases, DefaultExportSettings()); err != nil {
+		t.Fatal(err)
+	}
+	p, err := Open(Config{Backend: "replay", Replay: filename, ReplaySpeed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if _, ok := p.Out.(*Discard); !ok {
+		t.Errorf("The output of the replay backend is a %T. Expected it to discard what is written", p.Out)
+	}
+	if _, err := Open(Config{Backend: "replay", Replay: filename}); err == nil {
+		t.Error("Expected the replay backend to reject a speed of 0")
+	}
+}
+
+func TestReplayClose(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "replay.mid")
+	phrases := []Phrase{{Role: CallRole, Msgs: []model.Message{{Key: 60, Duration: 10000}}}}
+	if err := WriteMIDIFile(filename, phrases, DefaultExportSettings()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, listen := range []bool{true, false} {
+		r, err := NewReplay(filename, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if listen {
+			r.Listen()
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.Close()
+			}()
+		}
+		wg.Wait()
+		drain(t, r.Listen(), time.Second)
+	}
+}
@@ -0,0 +1,21 @@
+package midiio
+
+import "fmt"
+
+// DeviceError is returned when a MIDI device cannot be found or opened.
+type DeviceError struct {
+	Device string // the name the device was asked for. Empty is the default device
+	Input  bool
+	Err    error
+}
+
+func (e DeviceError) Error() string {
+	dir := "output"
+	if e.Input {
+		dir = "input"
+	}
+	if e.Device == "" {
+		return fmt.Sprintf("Default MIDI %v device: %v", dir, e.Err)
+	}
+	return fmt.Sprintf("MIDI %v device %q: %v", dir, e.Device, e.Err)
+}
@@ -0,0 +1,92 @@
+package midiio
+
+import (
+	"sync"
+)
+
+// AllNotesOffCC is the controller number of All Notes Off.
+const AllNotesOffCC = 123
+
+// NoteGuard is an Out that keeps track of the notes that are sounding on each channel, so that they can all be stopped.
+// It is safe to write to from multiple goroutines.
+type NoteGuard struct {
+	sync.Mutex
+	Out
+	sounding [16]map[byte]int // number of NoteOns without a NoteOff, by channel and key
+}
+
+// NewNoteGuard guards the output.
+func NewNoteGuard(out Out) *NoteGuard {
+	g := &NoteGuard{Out: out}
+	for i := range g.sounding {
+		g.sounding[i] = make(map[byte]int)
+	}
+	return g
+}
+
+// WriteShort writes the message and keeps track of the notes it starts and stops.
+func (g *NoteGuard) WriteShort(status, data1, data2 int64) error {
+	g.Lock()
+	defer g.Unlock()
+	if err := g.Out.WriteShort(status, data1, data2); err != nil {
+		return err
+	}
+
+	typ, ch := ParseStatus(byte(status))
+	key := ParseData(byte(data1))
+	switch {
+	case typ == NoteOnStatus && data2 > 0:
+		g.sounding[ch][key]++
+	case typ == NoteOnStatus, typ == NoteOffStatus:
+		if g.sounding[ch][key] <= 1 {
+			delete(g.sounding[ch], key)
+		} else {
+			g.sounding[ch][key]--
+		}
+	case typ == ControlChangeStatus && key == AllNotesOffCC:
+		g.sounding[ch] = make(map[byte]int)
+	}
+	return nil
+}
+
+// AllOff sends a NoteOff for every note that is sounding, then All Notes Off (CC 123) on every channel, for synths that missed any of them.
+// It carries on if a write fails, and returns the first error.
+func (g *NoteGuard) AllOff() (err error) {
+	g.Lock()
+	defer g.Unlock()
+	write := func(status, data1, data2 int64) {
+		if werr := g.Out.WriteShort(status, data1, data2); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	for ch := range g.sounding {
+		for key := range g.sounding[ch] {
+			write(int64(NoteOffStatus<<4|ch), int64(key), 0)
+		}
+		write(int64(ControlChangeStatus<<4|ch), AllNotesOffCC, 0)
+		g.sounding[ch] = make(map[byte]int)
+	}
+	return err
+}
+
+// StopAllNotes stops all the notes that are sounding on the output. Outputs that are not guarded only get All Notes Off.
+func StopAllNotes(out Out) error {
+	if g, ok := out.(*NoteGuard); ok {
+		return g.AllOff()
+	}
+	var err error
+	for ch := int64(0); ch < 16; ch++ {
+		if werr := out.WriteShort(ControlChangeStatus<<4|ch, AllNotesOffCC, 0); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// SilenceOnPanic stops all the notes on the output if the goroutine is panicking, and then carries on panicking. It must be deferred.
+func SilenceOnPanic(out Out) {
+	if r := recover(); r != nil {
+		StopAllNotes(out)
+		panic(r)
+	}
+}
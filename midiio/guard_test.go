@@ -0,0 +1,139 @@
+package midiio
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// stopped returns the keys that are stopped on each channel by NoteOffs, sorted, and how many All Notes Off each channel got.
+func stopped(evs []Event) (offs map[int64][]int64, allOff map[int64]int) {
+	offs, allOff = make(map[int64][]int64), make(map[int64]int)
+	for _, ev := range evs {
+		typ, ch := ParseStatus(byte(ev.Status))
+		switch {
+		case typ == NoteOffStatus, typ == NoteOnStatus && ev.Data2 == 0:
+			offs[int64(ch)] = append(offs[int64(ch)], ev.Data1)
+		case typ == ControlChangeStatus && ev.Data1 == AllNotesOffCC:
+			allOff[int64(ch)]++
+		}
+	}
+	for _, keys := range offs {
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	}
+	return offs, allOff
+}
+
+// play writes notes to a guarded fake device. At the end, keys 60 and 62 are sounding on channel 0, and key 70 on channel 3.
+func play(t *testing.T) (*NoteGuard, *Fake) {
+	t.Helper()
+	f := NewFake()
+	g := NewNoteGuard(f)
+	for _, m := range [][3]int64{
+		{0x90, 60, 100},
+		{0x90, 60, 90}, // doubled, so one NoteOff leaves it sounding
+		{0x80, 60, 0},
+		{0x90, 62, 100},
+		{0x90, 64, 100},
+		{0x90, 64, 0}, // NoteOn with velocity 0 is a NoteOff
+		{0x93, 70, 100},
+		{0x95, 50, 100},
+		{0xB5, AllNotesOffCC, 0},
+		{0x81, 61, 0}, // NoteOff of a note that isn't sounding
+	} {
+		if err := g.WriteShort(m[0], m[1], m[2]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return g, f
+}
+
+func TestStopAllNotes(t *testing.T) {
+	g, f := play(t)
+	played := len(f.Written())
+	if err := StopAllNotes(g); err != nil {
+		t.Fatal(err)
+	}
+	offs, allOff := stopped(f.Written()[played:])
+	if want := map[int64][]int64{0: {60, 62}, 3: {70}}; !reflect.DeepEqual(offs, want) {
+		t.Errorf("Stopped %v. Want %v", offs, want)
+	}
+	for ch := int64(0); ch < 16; ch++ {
+		if allOff[ch] != 1 {
+			t.Errorf("Channel %d got %d All Notes Off. Want 1", ch, allOff[ch])
+		}
+	}
+
+	// nothing is sounding anymore
+	stoppedAt := len(f.Written())
+	if err := StopAllNotes(g); err != nil {
+		t.Fatal(err)
+	}
+	if offs, _ := stopped(f.Written()[stoppedAt:]); len(offs) != 0 {
+		t.Errorf("Stopped %v again", offs)
+	}
+}
+
+func TestStopAllNotesUnguarded(t *testing.T) {
+	f := NewFake()
+	f.WriteShort(0x90, 60, 100)
+	if err := StopAllNotes(f); err != nil {
+		t.Fatal(err)
+	}
+	offs, allOff := stopped(f.Written())
+	if len(offs) != 0 || len(allOff) != 16 {
+		t.Errorf("Expected only All Notes Off on each channel. Got %v", f.Written())
+	}
+
+	f.Close()
+	if err := StopAllNotes(f); err == nil {
+		t.Error("Expected the failed writes to be returned")
+	}
+}
+
+func TestAllOffCarriesOn(t *testing.T) {
+	g, f := play(t)
+	f.Close()
+	if err := g.AllOff(); err == nil {
+		t.Error("Expected the failed writes to be returned")
+	}
+	if err := g.WriteShort(0x90, 72, 100); err == nil {
+		t.Error("Expected writing to a closed device to fail")
+	}
+	for ch, keys := range g.sounding {
+		if len(keys) != 0 {
+			t.Errorf("Channel %d is still sounding %v", ch, keys)
+		}
+	}
+}
+
+func TestSilenceOnPanic(t *testing.T) {
+	g, f := play(t)
+	played := len(f.Written())
+
+	// not panicking
+	func() {
+		defer SilenceOnPanic(g)
+	}()
+	if len(f.Written()) != played {
+		t.Fatalf("Expected nothing to be written without a panic. Got %v", f.Written()[played:])
+	}
+
+	var recovered interface{}
+	func() {
+		defer func() { recovered = recover() }()
+		defer SilenceOnPanic(g)
+		g.WriteShort(0x9F, 80, 100)
+		panic("boom")
+	}()
+	if recovered != "boom" {
+		t.Errorf("Expected the panic to carry on. Recovered %v", recovered)
+	}
+	offs, allOff := stopped(f.Written()[played+1:])
+	if want := map[int64][]int64{0: {60, 62}, 3: {70}, 15: {80}}; !reflect.DeepEqual(offs, want) {
+		t.Errorf("Stopped %v. Want %v", offs, want)
+	}
+	if len(allOff) != 16 {
+		t.Errorf("Expected All Notes Off on each channel. Got %v", allOff)
+	}
+}
@@ -0,0 +1,621 @@
+// Package midiio reads and writes call and response phrases as MIDI files, and talks to MIDI devices.
+package midiio
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/gomidi/midi"
+	"github.com/gomidi/midi/midimessage/channel"
+	"github.com/gomidi/midi/midimessage/meta"
+	"github.com/gomidi/midi/smf"
+	"github.com/gomidi/midi/smf/smfreader"
+	"github.com/gomidi/midi/smf/smftrack"
+	"github.com/pkg/errors"
+
+	"github.com/chewxy/gopherconsg2018/model"
+)
+
+type channeler interface {
+	Channel() byte
+}
+
+// DefaultResolution is the resolution of exported MIDI files, in ticks per quarter note.
+const DefaultResolution = smf.MetricTicks(480)
+
+// Role is the part a channel (or track) plays in a call-and-response exchange
+type Role byte
+
+const (
+	NoRole Role = iota
+	CallRole
+	ResponseRole
+)
+
+// PartMap describes which channels (or tracks) of a MIDI file are the call and which are the response.
+type PartMap struct {
+	byTrack bool
+	roles   map[int]Role
+}
+
+// NewPartMap makes a part map of the channels (or tracks, if byTrack is true) of the call and the response.
+func NewPartMap(call, response []int, byTrack bool) (pm PartMap, err error) {
+	pm = PartMap{
+		byTrack: byTrack,
+		roles:   make(map[int]Role),
+	}
+	if err = pm.add(call, CallRole); err != nil {
+		return
+	}
+	if err = pm.add(response, ResponseRole); err != nil {
+		return
+	}
+	return pm, nil
+}
+
+func (pm PartMap) add(ids []int, r Role) error {
+	if len(ids) == 0 {
+		return errors.New("No channels or tracks")
+	}
+	for _, id := range ids {
+		if id < 0 || (!pm.byTrack && id > 15) {
+			return errors.Errorf("%d is not a valid channel or track", id)
+		}
+		if _, ok := pm.roles[id]; ok {
+			return errors.Errorf("%d is used more than once", id)
+		}
+		pm.roles[id] = r
+	}
+	return nil
+}
+
+// role returns the role of a message on the given track and channel.
+func (pm PartMap) role(track uint16, ch byte) Role {
+	if pm.byTrack {
+		return pm.roles[int(track)]
+	}
+	return pm.roles[int(ch)]
+}
+
+// voice is what notes are paired and rests are computed in: a channel, or a channel of a track if the parts are split by track,
+// as the call and the response are often on the same channel of different tracks then.
+type voice struct {
+	track   uint16
+	channel byte
+}
+
+// voice returns the voice of a message on the given track and channel.
+func (pm PartMap) voice(track uint16, ch byte) voice {
+	if !pm.byTrack {
+		track = 0
+	}
+	return voice{track, ch}
+}
+
+// event is a smftrack.Event that remembers which track it came from
+type event struct {
+	smftrack.Event
+	track uint16
+}
+
+// events sorts by time. See decode for the order of simultaneous events.
+type events []event
+
+func (s events) Len() int           { return len(s) }
+func (s events) Less(i, j int) bool { return s[i].AbsTicks < s[j].AbsTicks }
+func (s events) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Decoder decodes the call and response pairs of a MIDI file.
+type Decoder struct {
+	parts      PartMap
+	resolution smf.MetricTicks // of the file that was read
+	msgs       events
+	timeSig    *meta.TimeSignature
+	tempo      meta.Tempo // the first tempo of the file. 0 if it has none
+	tempoMap   bool       // the tempo changes after the first
+	err        error
+
+	// filled in by decode()
+	unmatchedOn  int
+	unmatchedOff int
+}
+
+// NewDecoder creates a decoder that reads the parts of the part map.
+func NewDecoder(parts PartMap) *Decoder {
+	return &Decoder{parts: parts}
+}
+
+// ReadFile reads the channel messages of a MIDI file. Reading another file replaces the messages of the previous one.
+func (d *Decoder) ReadFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return d.Read(f)
+}
+
+// Read reads the channel messages of a MIDI file from the reader. See ReadFile.
+func (d *Decoder) Read(r io.Reader) error {
+	if err := readSMF(r, d.readMIDI); err != nil {
+		return err
+	}
+	return d.err
+}
+
+// readSMF reads the header of a MIDI file, and then calls read to read the rest.
+// smfreader.ReadFile is not used, as some versions of it count the tracks wrongly and reject complete files.
+func readSMF(r io.Reader, read func(smf.Reader)) error {
+	rd := smfreader.New(r)
+	if err := rd.ReadHeader(); err != nil {
+		return err
+	}
+	read(rd)
+	return nil
+}
+
+// Resolution returns the resolution of the MIDI file that was read, in ticks per quarter note.
+func (d *Decoder) Resolution() smf.MetricTicks { return d.resolution }
+
+// Tempo returns the tempo of the MIDI file that was read, in beats per minute. Files without a tempo are at 120 BPM.
+// An error is returned if the tempo changes, as the durations are not converted across tempo changes.
+func (d *Decoder) Tempo() (bpm uint32, err error) {
+	switch {
+	case d.tempoMap:
+		return 0, errors.New("The tempo changes. Only files with a single tempo are supported")
+	case d.tempo == 0:
+		return 120, nil
+	}
+	return d.tempo.BPM(), nil
+}
+
+// Unmatched returns the number of NoteOns without a NoteOff and NoteOffs without a NoteOn that the last decode found.
+func (d *Decoder) Unmatched() (on, off int) { return d.unmatchedOn, d.unmatchedOff }
+
+func (d *Decoder) readMIDI(rd smf.Reader) {
+	d.msgs, d.timeSig, d.tempo, d.tempoMap, d.err = nil, nil, 0, false, nil
+	var ok bool
+	if d.resolution, ok = rd.Header().TimeFormat.(smf.MetricTicks); !ok {
+		d.err = errors.New("Only metric time formats are supported")
+		return
+	}
+	if d.resolution == 0 {
+		d.err = errors.New("The resolution must be above 0 ticks per quarter note")
+		return
+	}
+	slog.Debug("Reading MIDI", "resolution", d.resolution, "delta", rd.Delta(), "type", rd.Header().Type())
+	v1 := smftrack.SMF1{}
+	var tracks []*smftrack.Track
+	tracks, d.err = v1.ReadFrom(rd)
+
+	// var i int
+	var t *smftrack.Track
+	each := func(e smftrack.Event) {
+		// log.Printf("Track %d. Message %v", i, e)
+		if ts, ok := e.Message.(meta.TimeSignature); ok && d.timeSig == nil {
+			d.timeSig = &ts
+		}
+		if tp, ok := e.Message.(meta.Tempo); ok {
+			if d.tempo == 0 {
+				d.tempo = tp
+			} else if tp != d.tempo {
+				d.tempoMap = true
+			}
+		}
+		if c, ok := e.Message.(channeler); ok && d.parts.role(t.Number, c.Channel()) != NoRole {
+			d.msgs = append(d.msgs, event{Event: e, track: t.Number})
+		}
+	}
+	for _, t = range tracks {
+		t.EachEvent(each)
+	}
+
+}
+
+// note is a decoded message, along with when it starts and which part it belongs to
+type note struct {
+	model.Message
+	start uint64 // in ticks
+	role  Role
+}
+
+// NoteKey identifies a sounding note
+type NoteKey struct {
+	Channel, Key byte
+}
+
+// AsNoteOff returns the channel and key of a message if it turns a note off. A NoteOn with a velocity of 0 is a NoteOff.
+func AsNoteOff(msg midi.Message) (k NoteKey, ok bool) {
+	switch m := msg.(type) {
+	case channel.NoteOff:
+		return NoteKey{m.Channel(), m.Key()}, true
+	case channel.NoteOffVelocity:
+		return NoteKey{m.Channel(), m.Key()}, true
+	case channel.NoteOn:
+		if m.Velocity() == 0 {
+			return NoteKey{m.Channel(), m.Key()}, true
+		}
+	}
+	return NoteKey{}, false
+}
+
+// voiceKey identifies a sounding note in decode
+type voiceKey struct {
+	voice
+	key byte
+}
+
+// decode turns the NoteOn and NoteOff events into a time ordered list of notes and rests.
+//
+// Active notes are tracked per voice (see PartMap.voice). Overlapping notes of the same key are turned off in the order that they were turned on.
+// A rest starts when the last sounding note of a voice is turned off, and ends when the next note of that voice
+// (or the next note of the other part) starts. NoteOns that are never turned off, and rests that never end, are dropped.
+// The number of unmatched NoteOns and NoteOffs are recorded in the decoder.
+//
+// Of the events at the same tick, the NoteOffs of notes that started earlier come first, so that a note that ends when another starts does not overlap it.
+// The rest keep the order of the file, so a NoteOn and a NoteOff of the same key at the same tick are a note with no length.
+func (d *Decoder) decode() (retVal []note) {
+	sort.Stable(d.msgs) // tracks are read in order, so simultaneous events keep their track order
+
+	active := make(map[voiceKey][]int) // indices of the notes that are waiting for a NoteOff, oldest first
+	sounding := make(map[voice]int)    // number of sounding notes per voice
+	rests := make(map[voice]int)       // index of the open rest of each voice
+	d.unmatchedOn, d.unmatchedOff = 0, 0
+
+	// waiting returns the notes that a NoteOff may turn off
+	waiting := func(ev event, off NoteKey) (voiceKey, []int) {
+		k := voiceKey{d.parts.voice(ev.track, off.Channel), off.Key}
+		return k, active[k]
+	}
+	noteOff := func(ev event, off NoteKey) {
+		k, w := waiting(ev, off)
+		if len(w) == 0 {
+			d.unmatchedOff++
+			return
+		}
+		on := w[0]
+		active[k] = w[1:]
+		retVal[on].Duration = uint(ev.AbsTicks - retVal[on].start)
+
+		if sounding[k.voice]--; sounding[k.voice] == 0 {
+			rests[k.voice] = len(retVal)
+			rest := model.Message{
+				Channel:  off.Channel,
+				Key:      model.Rest,
+				Velocity: 0,
+			}
+			retVal = append(retVal, note{rest, ev.AbsTicks, d.parts.role(ev.track, off.Channel)})
+		}
+	}
+	noteOn := func(ev event) {
+		msg, ok := ev.Message.(channel.NoteOn)
+		if !ok {
+			return
+		}
+		m := model.Message{
+			Channel:  msg.Channel(),
+			Key:      msg.Key(),
+			Velocity: msg.Velocity(),
+		}
+		r := d.parts.role(ev.track, m.Channel)
+		v := d.parts.voice(ev.track, m.Channel)
+
+		// end the rests of this voice, and of the other part
+		for rv, i := range rests {
+			if rv == v || retVal[i].role != r {
+				retVal[i].Duration = uint(ev.AbsTicks - retVal[i].start)
+				delete(rests, rv)
+			}
+		}
+
+		k := voiceKey{v, m.Key}
+		active[k] = append(active[k], len(retVal))
+		sounding[v]++
+		retVal = append(retVal, note{m, ev.AbsTicks, r})
+	}
+
+	for i := 0; i < len(d.msgs); {
+		j := i
+		for j < len(d.msgs) && d.msgs[j].AbsTicks == d.msgs[i].AbsTicks {
+			j++
+		}
+		tick := d.msgs[i:j]
+		done := make([]bool, len(tick))
+		for n, ev := range tick {
+			if off, ok := AsNoteOff(ev.Message); ok {
+				if _, w := waiting(ev, off); len(w) > 0 && retVal[w[0]].start < ev.AbsTicks {
+					noteOff(ev, off)
+					done[n] = true
+				}
+			}
+		}
+		for n, ev := range tick {
+			if done[n] {
+				continue
+			}
+			if off, ok := AsNoteOff(ev.Message); ok {
+				noteOff(ev, off)
+			} else {
+				noteOn(ev)
+			}
+		}
+		i = j
+	}
+
+	// drop the notes that were never turned off, the rests that never ended and the rests with no length
+	drop := make(map[int]bool)
+	for _, waiting := range active {
+		d.unmatchedOn += len(waiting)
+		for _, i := range waiting {
+			drop[i] = true
+		}
+	}
+	for _, i := range rests {
+		drop[i] = true
+	}
+	n := 0
+	for i, nt := range retVal {
+		if drop[i] || (nt.Key == model.Rest && nt.Duration == 0) {
+			continue
+		}
+		retVal[n] = nt
+		n++
+	}
+	return retVal[:n]
+}
+
+// Pairs decodes the messages into call and response pairs. No augmentation is done here - see model.Pipeline
+func (d *Decoder) Pairs() (retVal []model.Pair) {
+	cur := CallRole
+	var p model.Pair
+	for _, n := range d.decode() {
+		m := n.Message
+		switch {
+		case n.role == cur && cur == CallRole:
+			p.In = append(p.In, m)
+		case n.role == cur && cur == ResponseRole:
+			p.Out = append(p.Out, m)
+		case n.role != cur && cur == CallRole:
+			cur = n.role
+			p.Out = append(p.Out, m)
+		case n.role != cur && cur == ResponseRole:
+			cur = n.role
+			retVal = append(retVal, p)
+			p = model.Pair{
+				In: []model.Message{m},
+			}
+		}
+	}
+	if len(p.In) > 0 && len(p.Out) > 0 {
+		retVal = append(retVal, p)
+	}
+	return retVal
+}
+
+// Call decodes the messages of the call parts as a single phrase, such as a phrase that is to be responded to. The response parts are ignored.
+func (d *Decoder) Call() (retVal []model.Message) {
+	for _, n := range d.decode() {
+		if n.role == CallRole {
+			retVal = append(retVal, n.Message)
+		}
+	}
+	return retVal
+}
+
+// SegmentedPairs splits a single performance into phrases, and pairs each phrase with the phrase that follows it.
+// The roles of the channels are ignored - all notes that are read are treated as one performance.
+func (d *Decoder) SegmentedPairs(seg Segmenter) (retVal []model.Pair) {
+	phrases := seg.split(d.decode(), uint64(d.resolution.Ticks4th()), d.barTicks())
+	for i := 1; i < len(phrases); i++ {
+		retVal = append(retVal, model.Pair{In: phrases[i-1], Out: phrases[i]})
+	}
+	return retVal
+}
+
+// barTicks returns the length of a bar in ticks, using the first time signature found (4/4 if there is none).
+func (d *Decoder) barTicks() uint64 {
+	num, denom := uint64(4), uint64(4)
+	if d.timeSig != nil {
+		num, denom = uint64(d.timeSig.Numerator), uint64(d.timeSig.Denominator)
+	}
+	if denom == 0 {
+		denom = 4
+	}
+	return uint64(d.resolution.Ticks4th()) * 4 * num / denom
+}
+
+// DefaultVelocity is the velocity of notes that are exported without one
+const DefaultVelocity = 100
+
+// Phrase is a sequence of messages played by one part.
+type Phrase struct {
+	Role  Role
+	Msgs  []model.Message
+	Start uint64 // ticks after the lead-in. Only used if the export is timed
+}
+
+// PairPhrases returns the call and the response of the training pair as phrases.
+func PairPhrases(p model.Pair) []Phrase {
+	return []Phrase{
+		{Role: CallRole, Msgs: p.In},
+		{Role: ResponseRole, Msgs: p.Out},
+	}
+}
+
+// ExportTrack describes a track of an exported MIDI file. A track plays all the phrases of its role.
+type ExportTrack struct {
+	Role     Role
+	Channel  byte
+	Program  byte
+	Volume   byte
+	Pan      byte
+	Velocity byte // if non-zero, overrides the velocity of the notes
+}
+
+// ExportSettings describes how phrases are written to a MIDI file.
+type ExportSettings struct {
+	Resolution  smf.MetricTicks
+	BPM         uint32
+	Numerator   uint8
+	Denominator uint8
+	LeadIn      uint64 // ticks of silence before the first phrase
+	Timed       bool   // if true, each phrase starts at its start tick instead of after the previous phrase
+	Tracks      []ExportTrack
+}
+
+// DefaultExportSettings returns the settings used in the demo: an oboe on channel 0 for the call, and a trumpet on channel 1 for the response,
+// at the default resolution.
+func DefaultExportSettings() ExportSettings { return exportSettings(DefaultResolution) }
+
+// ExportSettings returns the default export settings at the resolution of the MIDI file that was read, so that its durations can be written back.
+func (d *Decoder) ExportSettings() ExportSettings { return exportSettings(d.resolution) }
+
+func exportSettings(resolution smf.MetricTicks) ExportSettings {
+	return ExportSettings{
+		Resolution:  resolution,
+		BPM:         120,
+		Numerator:   4,
+		Denominator: 4,
+		LeadIn:      uint64(2 * resolution.Ticks4th()),
+		Tracks: []ExportTrack{
+			{Role: CallRole, Channel: 0, Program: 68, Volume: 100, Pan: 64},
+			{Role: ResponseRole, Channel: 1, Program: 57, Volume: 100, Pan: 64, Velocity: 110},
+		},
+	}
+}
+
+// WriteMIDI writes the phrases one after another (or at their start ticks, if the settings are timed) as a SMF1 file. The first track holds the tempo and time signature,
+// and is followed by one track for each of the export tracks.
+func WriteMIDI(w io.Writer, phrases []Phrase, settings ExportSettings) (err error) {
+	if settings.Resolution == 0 {
+		return errors.New("The resolution must be above 0")
+	}
+	if settings.BPM == 0 {
+		return errors.New("The tempo must be above 0 BPM")
+	}
+	conductor := smftrack.New(0)
+	conductor.AddEvents(
+		smftrack.Event{Message: meta.Tempo(settings.BPM)},
+		smftrack.Event{Message: meta.TimeSignature{Numerator: settings.Numerator, Denominator: settings.Denominator}},
+	)
+
+	tracks := []*smftrack.Track{conductor}
+	for i, t := range settings.Tracks {
+		if t.Channel > 15 {
+			return errors.Errorf("Track %d: %d is not a valid channel", i, t.Channel)
+		}
+		for _, v := range []struct {
+			name  string
+			value byte
+		}{{"program", t.Program}, {"volume", t.Volume}, {"pan", t.Pan}, {"velocity", t.Velocity}} {
+			if v.value > 127 {
+				return errors.Errorf("Track %d: %d is not a valid %v. Expected 0-127", i, v.value, v.name)
+			}
+		}
+		ch := channel.New(t.Channel)
+		track := smftrack.New(uint16(i + 1))
+		track.AddEvents(
+			smftrack.Event{Message: ch.ControlChange(121, 0)}, // reset all controllers
+			smftrack.Event{Message: ch.ProgramChange(t.Program)},
+			smftrack.Event{Message: ch.ControlChange(7, t.Volume)},
+			smftrack.Event{Message: ch.ControlChange(10, t.Pan)},
+			smftrack.Event{Message: ch.ControlChange(91, 0)}, // reverb
+			smftrack.Event{Message: ch.ControlChange(93, 0)}, // chorus
+		)
+		tracks = append(tracks, track)
+	}
+
+	tick := settings.LeadIn
+	for _, p := range phrases {
+		if settings.Timed {
+			tick = settings.LeadIn + p.Start
+		}
+		for _, m := range p.Msgs {
+			if m.Key != model.Rest {
+				if m.Key > 127 {
+					return errors.Errorf("%d is not a valid key", m.Key)
+				}
+				if m.Velocity > 127 {
+					return errors.Errorf("%d is not a valid velocity", m.Velocity)
+				}
+				for i, t := range settings.Tracks {
+					if t.Role != p.Role {
+						continue
+					}
+					vel := t.Velocity
+					if vel == 0 {
+						vel = m.Velocity
+					}
+					if vel == 0 {
+						vel = DefaultVelocity
+					}
+					ch := channel.New(t.Channel)
+					tracks[i+1].AddEvents(
+						smftrack.Event{
+							AbsTicks: tick,
+							Message:  ch.NoteOn(m.Key, vel),
+						},
+						smftrack.Event{
+							AbsTicks: tick + uint64(m.Duration),
+							Message:  ch.NoteOff(m.Key),
+						},
+					)
+				}
+			}
+			tick += uint64(m.Duration)
+		}
+	}
+
+	if _, err = (smftrack.SMF1{}).WriteTo(w, settings.Resolution, tracks...); err != nil {
+		return errors.Wrap(err, "Unable to write MIDI")
+	}
+	return nil
+}
+
+// WriteMIDIFile writes the phrases to the given file. See WriteMIDI.
+// The phrases are written to a temporary file that then replaces the file, so that the file is never left half written.
+func WriteMIDIFile(filename string, phrases []Phrase, settings ExportSettings) (err error) {
+	var f *os.File
+	if f, err = os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp"); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if err = WriteMIDI(f, phrases, settings); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Chmod(0644); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// message types, as returned by ParseStatus
+const (
+	NoteOffStatus       = 0x8
+	NoteOnStatus        = 0x9
+	ControlChangeStatus = 0xB
+)
+
+// ParseStatus splits a status byte into the message type and channel.
+func ParseStatus(b byte) (messageType, messageChannel byte) {
+	messageType = (b & 0xF0) >> 4
+	messageChannel = b & 0x0F
+	return
+}
+
+// ParseData masks a data byte to 7 bits.
+func ParseData(b byte) byte {
+	return b & 0x7f
+}
@@ -0,0 +1,310 @@
+package midiio
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/gomidi/midi"
+	"github.com/gomidi/midi/midimessage/channel"
+	"github.com/gomidi/midi/smf"
+	"github.com/gomidi/midi/smf/smftrack"
+
+	"github.com/chewxy/gopherconsg2018/model"
+)
+
+// at is a message at the given tick
+func at(tick uint64, msg midi.Message) smftrack.Event {
+	return smftrack.Event{AbsTicks: tick, Message: msg}
+}
+
+// smfBytes writes a SMF1 file at 480 ticks per quarter note. Track 0 is empty, and each list of events is the next track.
+func smfBytes(t *testing.T, tracks ...[]smftrack.Event) []byte {
+	t.Helper()
+	all := []*smftrack.Track{smftrack.New(0)}
+	for i, evs := range tracks {
+		tr := smftrack.New(uint16(i + 1))
+		tr.AddEvents(evs...)
+		all = append(all, tr)
+	}
+	var buf bytes.Buffer
+	if _, err := (smftrack.SMF1{}).WriteTo(&buf, smf.MetricTicks(480), all...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+type decoded struct {
+	key  byte
+	dur  uint
+	role Role
+}
+
+func TestDecode(t *testing.T) {
+	ch0, ch1 := channel.Channel0, channel.Channel1
+	tests := []struct {
+		name    string
+		byTrack bool // call is track 1 and response is track 2. Otherwise call is channel 0 and response is channel 1
+		tracks  [][]smftrack.Event
+		want    []decoded
+
+		unmatchedOn, unmatchedOff int
+	}{
+		{
+			name: "call and response",
+			tracks: [][]smftrack.Event{{
+				at(0, ch0.NoteOn(60, 100)), at(480, ch0.NoteOff(60)),
+				at(480, ch1.NoteOn(62, 100)), at(960, ch1.NoteOff(62)),
+			}},
+			want: []decoded{{60, 480, CallRole}, {62, 480, ResponseRole}},
+		},
+		{
+			name: "NoteOn with velocity 0 ends a note",
+			tracks: [][]smftrack.Event{{
+				at(0, ch0.NoteOn(60, 100)), at(480, ch0.NoteOn(60, 0)),
+				at(480, ch1.NoteOn(62, 100)), at(960, ch1.NoteOn(62, 0)),
+			}},
+			want: []decoded{{60, 480, CallRole}, {62, 480, ResponseRole}},
+		},
+		{
+			name: "overlapping notes of the same key end in the order they started",
+			tracks: [][]smftrack.Event{{
+				at(0, ch0.NoteOn(60, 100)), at(240, ch0.NoteOn(60, 100)),
+				at(480, ch0.NoteOff(60)), at(720, ch0.NoteOff(60)),
+			}},
+			want: []decoded{{60, 480, CallRole}, {60, 480, CallRole}},
+		},
+		{
+			name: "a NoteOff only ends a note of its own channel",
+			tracks: [][]smftrack.Event{{
+				at(0, ch0.NoteOn(60, 100)), at(240, ch1.NoteOn(60, 100)),
+				at(480, ch1.NoteOff(60)), at(960, ch0.NoteOff(60)),
+			}},
+			want: []decoded{{60, 960, CallRole}, {60, 240, ResponseRole}},
+		},
+		{
+			name: "rest between notes",
+			tracks: [][]smftrack.Event{{
+				at(0, ch0.NoteOn(60, 100)), at(480, ch0.NoteOff(60)),
+				at(960, ch0.NoteOn(62, 100)), at(1440, ch0.NoteOff(62)),
+			}},
+			want: []decoded{{60, 480, CallRole}, {model.Rest, 480, CallRole}, {62, 480, CallRole}},
+		},
+		{
+			name: "no rest in a chord or in legato",
+			tracks: [][]smftrack.Event{{
+				at(0, ch0.NoteOn(60, 100)), at(0, ch0.NoteOn(64, 100)),
+				at(480, ch0.NoteOff(60)), at(480, ch0.NoteOff(64)),
+				at(480, ch0.NoteOn(67, 100)), at(960, ch0.NoteOff(67)),
+			}},
+			want: []decoded{{60, 480, CallRole}, {64, 480, CallRole}, {67, 480, CallRole}},
+		},
+		{
+			name: "a NoteOn and a NoteOff at the same tick are a note with no length",
+			tracks: [][]smftrack.Event{{
+				at(0, ch0.NoteOn(60, 100)), at(0, ch0.NoteOff(60)),
+				at(480, ch0.NoteOn(60, 100)), at(960, ch0.NoteOff(60)),
+			}},
+			want: []decoded{{60, 0, CallRole}, {model.Rest, 480, CallRole}, {60, 480, CallRole}},
+		},
+		{
+			name: "a note ends before the next note of the same key starts at the same tick",
+			tracks: [][]smftrack.Event{{
+				at(0, ch0.NoteOn(60, 100)),
+				at(480, ch0.NoteOn(60, 100)), at(480, ch0.NoteOff(60)),
+				at(960, ch0.NoteOff(60)),
+			}},
+			want: []decoded{{60, 480, CallRole}, {60, 480, CallRole}},
+		},
+		{
+			name: "unmatched notes are dropped and counted",
+			tracks: [][]smftrack.Event{{
+				at(0, ch0.NoteOff(62)),
+				at(0, ch0.NoteOn(60, 100)), at(480, ch0.NoteOff(60)),
+				at(480, ch0.NoteOn(64, 100)),
+			}},
+			want:         []decoded{{60, 480, CallRole}},
+			unmatchedOn:  1,
+			unmatchedOff: 1,
+		},
+		{
+			name:    "overlapping notes of the same channel on different tracks",
+			byTrack: true,
+			tracks: [][]smftrack.Event{
+				{at(0, ch0.NoteOn(60, 100)), at(960, ch0.NoteOff(60))},
+				{at(240, ch0.NoteOn(60, 100)), at(480, ch0.NoteOff(60))},
+			},
+			want: []decoded{{60, 960, CallRole}, {60, 240, ResponseRole}},
+		},
+		{
+			name:    "rests by track",
+			byTrack: true,
+			tracks: [][]smftrack.Event{
+				{at(0, ch0.NoteOn(60, 100)), at(480, ch0.NoteOff(60)), at(960, ch0.NoteOn(62, 100)), at(1440, ch0.NoteOff(62))},
+				{at(240, ch0.NoteOn(64, 100)), at(1440, ch0.NoteOff(64))},
+			},
+			want: []decoded{{60, 480, CallRole}, {64, 1200, ResponseRole}, {model.Rest, 480, CallRole}, {62, 480, CallRole}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			call, response := []int{0}, []int{1}
+			if tc.byTrack {
+				call, response = []int{1}, []int{2}
+			}
+			parts, err := NewPartMap(call, response, tc.byTrack)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := NewDecoder(parts)
+			if err := d.Read(bytes.NewReader(smfBytes(t, tc.tracks...))); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []decoded
+			for _, n := range d.decode() {
+				got = append(got, decoded{n.Key, n.Duration, n.role})
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("Got %v. Want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("Note %d: got %v. Want %v", i, got[i], tc.want[i])
+				}
+			}
+			if on, off := d.Unmatched(); on != tc.unmatchedOn || off != tc.unmatchedOff {
+				t.Errorf("Unmatched: got %d NoteOns and %d NoteOffs. Want %d and %d", on, off, tc.unmatchedOn, tc.unmatchedOff)
+			}
+		})
+	}
+}
+
+func TestWriteMIDIRoundTrip(t *testing.T) {
+	pairs := []model.Pair{
+		{
+			In: []model.Message{
+				{Channel: 0, Key: 60, Duration: 480, Velocity: 100},
+				{Channel: 0, Key: model.Rest, Duration: 240},
+				{Channel: 0, Key: 62, Duration: 240, Velocity: 80},
+			},
+			Out: []model.Message{{Channel: 1, Key: 64, Duration: 960, Velocity: 90}},
+		},
+		{
+			In: []model.Message{{Channel: 0, Key: 67, Duration: 120, Velocity: 100}},
+			Out: []model.Message{
+				{Channel: 1, Key: 65, Duration: 240, Velocity: 70},
+				{Channel: 1, Key: 64, Duration: 480, Velocity: 60},
+			},
+		},
+	}
+	settings := DefaultExportSettings()
+	settings.Resolution = 480
+	for i := range settings.Tracks {
+		settings.Tracks[i].Velocity = 0
+	}
+	var phrases []Phrase
+	for _, p := range pairs {
+		phrases = append(phrases, PairPhrases(p)...)
+	}
+	var buf bytes.Buffer
+	if err := WriteMIDI(&buf, phrases, settings); err != nil {
+		t.Fatal(err)
+	}
+
+	parts, err := NewPartMap([]int{0}, []int{1}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDecoder(parts)
+	if err := d.Read(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if d.Resolution() != settings.Resolution {
+		t.Errorf("Resolution: got %v. Want %v", d.Resolution(), settings.Resolution)
+	}
+	got := d.Pairs()
+	if !reflect.DeepEqual(got, pairs) {
+		t.Errorf("Got %v. Want %v", got, pairs)
+	}
+	if on, off := d.Unmatched(); on != 0 || off != 0 {
+		t.Errorf("Unmatched: got %d NoteOns and %d NoteOffs", on, off)
+	}
+}
+
+func TestZeroLengthNotesAreLinted(t *testing.T) {
+	ch0, ch1 := channel.Channel0, channel.Channel1
+	file := smfBytes(t, []smftrack.Event{
+		at(0, ch0.NoteOn(60, 100)), at(0, ch0.NoteOff(60)),
+		at(480, ch0.NoteOn(62, 100)), at(960, ch0.NoteOff(62)),
+		at(960, ch1.NoteOn(64, 100)), at(1440, ch1.NoteOff(64)),
+	})
+	parts, err := NewPartMap([]int{0}, []int{1}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDecoder(parts)
+	if err := d.Read(bytes.NewReader(file)); err != nil {
+		t.Fatal(err)
+	}
+	stats := model.CollectStats(d.Pairs(), 10000)
+	stats.UnmatchedOn, stats.UnmatchedOff = d.Unmatched()
+	problems := stats.Lint(model.LintThresholds{Unmatched: 0, ZeroLength: 0, Outliers: -1, Empty: 0})
+	if want := []string{"1 zero length notes (max 0)"}; !reflect.DeepEqual(problems, want) {
+		t.Errorf("Got %q. Want %q", problems, want)
+	}
+}
+
+func TestDecoderReadsOneFile(t *testing.T) {
+	ch0, ch1 := channel.Channel0, channel.Channel1
+	first := smfBytes(t, []smftrack.Event{at(0, ch0.NoteOn(60, 100)), at(480, ch0.NoteOff(60)), at(480, ch1.NoteOn(62, 100)), at(960, ch1.NoteOff(62))})
+	second := smfBytes(t, []smftrack.Event{at(0, ch0.NoteOn(64, 100)), at(240, ch0.NoteOff(64)), at(240, ch1.NoteOn(65, 100)), at(480, ch1.NoteOff(65))})
+
+	parts, err := NewPartMap([]int{0}, []int{1}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDecoder(parts)
+	for _, file := range [][]byte{first, second} {
+		if err := d.Read(bytes.NewReader(file)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []model.Pair{{
+		In:  []model.Message{{Channel: 0, Key: 64, Duration: 240, Velocity: 100}},
+		Out: []model.Message{{Channel: 1, Key: 65, Duration: 240, Velocity: 100}},
+	}}
+	if got := d.Pairs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v. Want the pairs of the second file %v", got, want)
+	}
+}
+
+func TestWriteMIDIRejects(t *testing.T) {
+	phrases := []Phrase{{Role: CallRole, Msgs: []model.Message{{Key: 60, Duration: 480}}}}
+	tests := []struct {
+		name   string
+		change func(s *ExportSettings)
+	}{
+		{"no tempo", func(s *ExportSettings) { s.BPM = 0 }},
+		{"no resolution", func(s *ExportSettings) { s.Resolution = 0 }},
+		{"channel", func(s *ExportSettings) { s.Tracks[0].Channel = 16 }},
+		{"program", func(s *ExportSettings) { s.Tracks[0].Program = 128 }},
+		{"volume", func(s *ExportSettings) { s.Tracks[0].Volume = 200 }},
+		{"pan", func(s *ExportSettings) { s.Tracks[1].Pan = 255 }},
+		{"velocity", func(s *ExportSettings) { s.Tracks[1].Velocity = 128 }},
+	}
+	for _, tc := range tests {
+		settings := DefaultExportSettings()
+		tc.change(&settings)
+		if err := WriteMIDI(ioutil.Discard, phrases, settings); err == nil {
+			t.Errorf("%v: expected an error", tc.name)
+		}
+	}
+
+	bad := []Phrase{{Role: CallRole, Msgs: []model.Message{{Key: 60, Duration: 480, Velocity: 128}}}}
+	if err := WriteMIDI(ioutil.Discard, bad, DefaultExportSettings()); err == nil {
+		t.Error("Velocity 128: expected an error")
+	}
+}
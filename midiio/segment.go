@@ -0,0 +1,56 @@
+package midiio
+
+import "github.com/chewxy/gopherconsg2018/model"
+
+// Segmenter splits a single performance into phrases, for MIDI files that do not have the call and response on separate channels.
+// A phrase ends at a rest that is at least Gap beats long, or every Bars bars. A zero value disables that rule.
+type Segmenter struct {
+	Gap  float64 // in beats
+	Bars int
+}
+
+// Enabled returns true if the segmenter splits anything.
+func (s Segmenter) Enabled() bool { return s.Gap > 0 || s.Bars > 0 }
+
+// split splits the notes into phrases. Leading and trailing rests of each phrase are dropped.
+func (s Segmenter) split(notes []note, beatTicks, barTicks uint64) (retVal [][]model.Message) {
+	gapTicks := uint(s.Gap * float64(beatTicks))
+	phraseTicks := barTicks * uint64(s.Bars)
+
+	var cur []model.Message
+	var group uint64
+	end := func() {
+		for len(cur) > 0 && cur[len(cur)-1].Key == model.Rest {
+			cur = cur[:len(cur)-1]
+		}
+		if len(cur) > 0 {
+			retVal = append(retVal, cur)
+		}
+		cur = nil
+	}
+
+	for _, n := range notes {
+		if n.Key == model.Rest {
+			switch {
+			case len(cur) == 0:
+				// leading rest
+			case gapTicks > 0 && n.Duration >= gapTicks:
+				end()
+			default:
+				cur = append(cur, n.Message)
+			}
+			continue
+		}
+
+		if phraseTicks > 0 {
+			g := n.start / phraseTicks
+			if g != group {
+				end()
+				group = g
+			}
+		}
+		cur = append(cur, n.Message)
+	}
+	end()
+	return retVal
+}
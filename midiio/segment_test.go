@@ -0,0 +1,125 @@
+package midiio
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/chewxy/gopherconsg2018/model"
+)
+
+// at 480 ticks per beat, in 4/4
+const (
+	beat = 480
+	bar  = 4 * beat
+)
+
+// played is a note of a performance
+func played(key byte, start uint64, dur uint) note {
+	return note{Message: model.Message{Key: key, Duration: dur, Velocity: 100}, start: start, role: CallRole}
+}
+
+func TestSegmenter(t *testing.T) {
+	tests := []struct {
+		name  string
+		seg   Segmenter
+		notes []note
+		want  [][]byte // keys of each phrase
+	}{
+		{
+			name:  "a gap ends a phrase",
+			seg:   Segmenter{Gap: 2},
+			notes: []note{played(60, 0, beat), played(model.Rest, beat, 2*beat), played(62, 3*beat, beat)},
+			want:  [][]byte{{60}, {62}},
+		},
+		{
+			name:  "a shorter rest is kept",
+			seg:   Segmenter{Gap: 2.5},
+			notes: []note{played(60, 0, beat), played(model.Rest, beat, 2*beat), played(62, 3*beat, beat)},
+			want:  [][]byte{{60, model.Rest, 62}},
+		},
+		{
+			name:  "no gap",
+			seg:   Segmenter{Gap: 1},
+			notes: []note{played(60, 0, beat), played(62, beat, beat), played(64, 2*beat, beat)},
+			want:  [][]byte{{60, 62, 64}},
+		},
+		{
+			name:  "a single note",
+			seg:   Segmenter{Gap: 1},
+			notes: []note{played(60, 0, beat)},
+			want:  [][]byte{{60}},
+		},
+		{
+			name:  "leading and trailing rests are dropped",
+			seg:   Segmenter{Gap: 4},
+			notes: []note{played(model.Rest, 0, beat), played(60, beat, beat), played(model.Rest, 2*beat, beat)},
+			want:  [][]byte{{60}},
+		},
+		{
+			name: "bar boundaries",
+			seg:  Segmenter{Bars: 1},
+			notes: []note{
+				played(60, 0, beat), played(62, 2*beat, beat),
+				played(64, bar, beat), played(65, bar+3*beat, beat),
+				played(67, 2*bar+beat, beat),
+			},
+			want: [][]byte{{60, 62}, {64, 65}, {67}},
+		},
+		{
+			name:  "a phrase of two bars",
+			seg:   Segmenter{Bars: 2},
+			notes: []note{played(60, 0, beat), played(62, bar, beat), played(64, 2*bar, beat)},
+			want:  [][]byte{{60, 62}, {64}},
+		},
+		{
+			name:  "a rest across a bar boundary is trailing",
+			seg:   Segmenter{Bars: 1},
+			notes: []note{played(60, 0, beat), played(model.Rest, beat, bar), played(62, bar+beat, beat)},
+			want:  [][]byte{{60}, {62}},
+		},
+		{
+			name: "gaps and bars",
+			seg:  Segmenter{Gap: 2, Bars: 1},
+			notes: []note{
+				played(60, 0, beat), played(model.Rest, beat, 2*beat), played(62, 3*beat, beat),
+				played(64, bar, beat),
+			},
+			want: [][]byte{{60}, {62}, {64}},
+		},
+		{
+			name: "no notes",
+			seg:  Segmenter{Gap: 1},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got [][]byte
+			for _, phrase := range tc.seg.split(tc.notes, beat, bar) {
+				var keys []byte
+				for _, m := range phrase {
+					keys = append(keys, m.Key)
+				}
+				got = append(got, keys)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Got %v. Want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSegmenterEnabled(t *testing.T) {
+	for _, tc := range []struct {
+		seg  Segmenter
+		want bool
+	}{
+		{Segmenter{}, false},
+		{Segmenter{Gap: 0.5}, true},
+		{Segmenter{Bars: 2}, true},
+	} {
+		if got := tc.seg.Enabled(); got != tc.want {
+			t.Errorf("%+v: got %t. Want %t", tc.seg, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package model
+
+import (
+	"math"
+	"math/rand"
+)
+
+// maxJitterDuration is the longest duration that the jitter and tempo steps will substitute in.
+const maxJitterDuration = 900
+
+// Augmenter is a step in the data augmentation pipeline. Each step is given the training pairs and the known durations, and returns the augmented training pairs.
+type Augmenter interface {
+	Augment(pairs []Pair, durations []uint) []Pair
+}
+
+// Pipeline is a list of augmentation steps, which are run in order.
+type Pipeline []Augmenter
+
+func (p Pipeline) Augment(pairs []Pair, durations []uint) []Pair {
+	for _, a := range p {
+		pairs = a.Augment(pairs, durations)
+	}
+	return pairs
+}
+
+// Select only keeps the pairs at the given indices. Indices that are out of range are ignored.
+type Select struct {
+	Indices []int
+}
+
+func (a Select) Augment(pairs []Pair, durations []uint) (retVal []Pair) {
+	for _, i := range a.Indices {
+		if i >= 0 && i < len(pairs) {
+			retVal = append(retVal, pairs[i])
+		}
+	}
+	return retVal
+}
+
+// Oversample adds `Times` extra copies of each of the pairs at the given indices.
+type Oversample struct {
+	Indices []int
+	Times   int
+}
+
+func (a Oversample) Augment(pairs []Pair, durations []uint) []Pair {
+	n := len(pairs)
+	for _, i := range a.Indices {
+		if i < 0 || i >= n {
+			continue
+		}
+		for count := 0; count < a.Times; count++ {
+			pairs = append(pairs, pairs[i])
+		}
+	}
+	return pairs
+}
+
+// DurationJitter adds `Copies` copies of each pair, with the duration of one randomly chosen input note replaced by a randomly chosen known duration.
+type DurationJitter struct {
+	Copies int
+	Rng    *rand.Rand
+}
+
+func (a DurationJitter) Augment(pairs []Pair, durations []uint) []Pair {
+	var candidates []uint
+	for _, dur := range durations {
+		if dur > 0 && dur <= maxJitterDuration {
+			candidates = append(candidates, dur)
+		}
+	}
+	if len(candidates) == 0 {
+		return pairs
+	}
+
+	n := len(pairs)
+	for i := 0; i < n; i++ {
+		p := pairs[i]
+		if len(p.In) == 0 {
+			continue
+		}
+		for count := 0; count < a.Copies; count++ {
+			newIn := make([]Message, len(p.In))
+			copy(newIn, p.In)
+			newIn[a.Rng.Intn(len(newIn))].Duration = candidates[a.Rng.Intn(len(candidates))]
+			pairs = append(pairs, Pair{In: newIn, Out: p.Out})
+		}
+	}
+	return pairs
+}
+
+// Transposition adds a copy of each pair, with both call and response shifted by a random number of semitones in [-Max, Max].
+// Copies that would shift a key out of the MIDI range are not added.
+type Transposition struct {
+	Max int
+	Rng *rand.Rand
+}
+
+func (a Transposition) Augment(pairs []Pair, durations []uint) []Pair {
+	if a.Max <= 0 {
+		return pairs
+	}
+	n := len(pairs)
+	for i := 0; i < n; i++ {
+		shift := a.Rng.Intn(2*a.Max) - a.Max
+		if shift >= 0 {
+			shift++ // never transpose by 0
+		}
+
+		in, ok1 := transposed(pairs[i].In, shift)
+		out, ok2 := transposed(pairs[i].Out, shift)
+		if ok1 && ok2 {
+			pairs = append(pairs, Pair{In: in, Out: out})
+		}
+	}
+	return pairs
+}
+
+// Keys returns the keys, and all the keys that they can be transposed to, in order. These are all the keys that the augmented pairs can have.
+func (a Transposition) Keys(keys []byte) (retVal []byte) {
+	var seen [128]bool
+	for _, k := range keys {
+		for shift := -a.Max; shift <= a.Max; shift++ {
+			if key := int(k) + shift; key >= 0 && key <= 127 {
+				seen[key] = true
+			}
+		}
+	}
+	for k, ok := range seen {
+		if ok {
+			retVal = append(retVal, byte(k))
+		}
+	}
+	return retVal
+}
+
+func transposed(msgs []Message, shift int) (retVal []Message, ok bool) {
+	retVal = make([]Message, len(msgs))
+	copy(retVal, msgs)
+	for i := range retVal {
+		if retVal[i].Key == Rest {
+			continue
+		}
+		key := int(retVal[i].Key) + shift
+		if key < 0 || key > 127 {
+			return nil, false
+		}
+		retVal[i].Key = byte(key)
+	}
+	return retVal, true
+}
+
+// TempoScale adds a copy of each pair, with all durations scaled by a random factor in [1-Max, 1+Max].
+// The scaled durations are snapped to the closest known duration so that the vocabulary does not blow up.
+type TempoScale struct {
+	Max float64
+	Rng *rand.Rand
+}
+
+func (a TempoScale) Augment(pairs []Pair, durations []uint) []Pair {
+	if a.Max <= 0 || len(durations) == 0 {
+		return pairs
+	}
+	n := len(pairs)
+	for i := 0; i < n; i++ {
+		factor := 1 + (a.Rng.Float64()*2-1)*a.Max
+		pairs = append(pairs, Pair{
+			In:  scaled(pairs[i].In, factor, durations),
+			Out: scaled(pairs[i].Out, factor, durations),
+		})
+	}
+	return pairs
+}
+
+func scaled(msgs []Message, factor float64, durations []uint) []Message {
+	retVal := make([]Message, len(msgs))
+	copy(retVal, msgs)
+	for i := range retVal {
+		dur := uint(math.Floor(float64(retVal[i].Duration)*factor + 0.5))
+		retVal[i].Duration = closestDuration(durations, dur)
+	}
+	return retVal
+}
+
+// NoteDropout adds a copy of each pair, with each input note dropped with probability P. At least one note is always kept.
+type NoteDropout struct {
+	P   float64
+	Rng *rand.Rand
+}
+
+func (a NoteDropout) Augment(pairs []Pair, durations []uint) []Pair {
+	if a.P <= 0 {
+		return pairs
+	}
+	n := len(pairs)
+	for i := 0; i < n; i++ {
+		p := pairs[i]
+		var in []Message
+		for _, m := range p.In {
+			if m.Key != Rest && a.Rng.Float64() < a.P {
+				continue
+			}
+			in = append(in, m)
+		}
+		if len(in) == len(p.In) || !hasNotes(in) {
+			continue
+		}
+		pairs = append(pairs, Pair{In: in, Out: p.Out})
+	}
+	return pairs
+}
+
+func hasNotes(msgs []Message) bool {
+	for _, m := range msgs {
+		if m.Key != Rest {
+			return true
+		}
+	}
+	return false
+}
+
+// closestDuration returns the duration in durations that is closest to d.
+func closestDuration(durations []uint, d uint) uint {
+	var retVal uint
+	var minDiff = int((^uint(0)) >> 1)
+	for _, dur := range durations {
+		diff := int(dur) - int(d)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff < minDiff {
+			minDiff = diff
+			retVal = dur
+		}
+	}
+	return retVal
+}
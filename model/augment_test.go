@@ -0,0 +1,108 @@
+package model
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+var augmentDurations = []uint{120, 240, 480, 960}
+
+// augmentPairs are pairs of random phrases. The rests have known durations too, so that every duration is in the vocabulary.
+func augmentPairs(n int) []Pair {
+	rng := rand.New(rand.NewSource(42))
+	phrase := func(ch byte) (msgs []Message) {
+		for i := 0; i < 1+rng.Intn(6); i++ {
+			key := byte(50 + rng.Intn(30))
+			if i > 0 && rng.Intn(4) == 0 {
+				key = Rest
+			}
+			msgs = append(msgs, Message{Channel: ch, Key: key, Duration: augmentDurations[rng.Intn(len(augmentDurations))], Velocity: 100})
+		}
+		return msgs
+	}
+	pairs := make([]Pair, n)
+	for i := range pairs {
+		pairs[i] = Pair{In: phrase(0), Out: phrase(1)}
+	}
+	pairs = append(pairs, Pair{ // can only be transposed down
+		In:  []Message{{Key: 126, Duration: 120}, {Key: 60, Duration: 240}, {Key: 62, Duration: 480}, {Key: 64, Duration: 960}},
+		Out: []Message{{Channel: 1, Key: 127, Duration: 240}},
+	})
+	return pairs
+}
+
+func pipeline(seed int64) Pipeline {
+	rng := func(step int64) *rand.Rand { return rand.New(rand.NewSource(seed + step)) }
+	return Pipeline{
+		DurationJitter{Copies: 2, Rng: rng(1)},
+		Transposition{Max: 3, Rng: rng(2)},
+		TempoScale{Max: 0.5, Rng: rng(3)},
+		NoteDropout{P: 0.3, Rng: rng(4)},
+	}
+}
+
+func TestPipelineIsRepeatable(t *testing.T) {
+	pairs := augmentPairs(20)
+	_, durations := Vocabulary(pairs)
+	first := pipeline(1).Augment(append([]Pair(nil), pairs...), durations)
+	second := pipeline(1).Augment(append([]Pair(nil), pairs...), durations)
+	if !reflect.DeepEqual(first, second) {
+		t.Error("Expected the same seed to give the same pairs")
+	}
+	if other := pipeline(2).Augment(append([]Pair(nil), pairs...), durations); reflect.DeepEqual(first, other) {
+		t.Error("Expected another seed to give other pairs")
+	}
+	if !reflect.DeepEqual(first[:len(pairs)], pairs) {
+		t.Error("Expected the original pairs to be kept")
+	}
+}
+
+func TestAugmentersStayInTheVocabulary(t *testing.T) {
+	pairs := augmentPairs(50)
+	keys, durations := Vocabulary(pairs)
+	if !reflect.DeepEqual(durations, augmentDurations) {
+		t.Fatalf("Unexpected test durations %v", durations)
+	}
+	rng := func() *rand.Rand { return rand.New(rand.NewSource(7)) }
+	tests := []struct {
+		name string
+		a    Augmenter
+		keys []byte // the keys that the augmented pairs may have
+	}{
+		{"transposition", Transposition{Max: 3, Rng: rng()}, Transposition{Max: 3}.Keys(keys)},
+		{"tempo", TempoScale{Max: 0.5, Rng: rng()}, keys},
+		{"dropout", NoteDropout{P: 0.5, Rng: rng()}, keys},
+		{"jitter", DurationJitter{Copies: 3, Rng: rng()}, keys},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			allowedKeys := make(map[byte]bool)
+			for _, k := range tc.keys {
+				allowedKeys[k] = true
+			}
+			allowedDurations := make(map[uint]bool)
+			for _, d := range durations {
+				allowedDurations[d] = true
+			}
+
+			got := tc.a.Augment(append([]Pair(nil), pairs...), durations)
+			if len(got) <= len(pairs) {
+				t.Fatalf("No pairs were added")
+			}
+			for i, p := range got {
+				if !hasNotes(p.In) || !hasNotes(p.Out) {
+					t.Errorf("Pair %d has an empty side: %v", i, p)
+				}
+				for _, m := range append(append([]Message(nil), p.In...), p.Out...) {
+					if m.Key != Rest && !allowedKeys[m.Key] {
+						t.Errorf("Pair %d has key %d, which is out of the vocabulary", i, m.Key)
+					}
+					if !allowedDurations[m.Duration] {
+						t.Errorf("Pair %d has duration %d, which is out of the vocabulary", i, m.Duration)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package model
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// JSONMessage is the serialized form of a message. A key of 255 is a rest.
+type JSONMessage struct {
+	Key      byte `json:"key"`
+	Duration uint `json:"duration"`
+	Velocity byte `json:"velocity"`
+	Channel  byte `json:"channel"`
+}
+
+// JSONPair is the serialized form of a Pair. Each line of a dataset file is one JSONPair.
+type JSONPair struct {
+	In  []JSONMessage `json:"in"`
+	Out []JSONMessage `json:"out"`
+}
+
+// ToJSON returns the serialized form of the messages.
+func ToJSON(msgs []Message) []JSONMessage {
+	retVal := make([]JSONMessage, len(msgs))
+	for i, m := range msgs {
+		retVal[i] = JSONMessage{
+			Key:      m.Key,
+			Duration: m.Duration,
+			Velocity: m.Velocity,
+			Channel:  m.Channel,
+		}
+	}
+	return retVal
+}
+
+// FromJSON returns the messages of their serialized form.
+func FromJSON(msgs []JSONMessage) []Message {
+	retVal := make([]Message, len(msgs))
+	for i, m := range msgs {
+		retVal[i] = Message{
+			Key:      m.Key,
+			Duration: m.Duration,
+			Velocity: m.Velocity,
+			Channel:  m.Channel,
+		}
+	}
+	return retVal
+}
+
+// IsDataset returns true if the file name looks like a JSONL dataset rather than a MIDI file.
+func IsDataset(filename string) bool {
+	return strings.HasSuffix(strings.ToLower(filename), ".jsonl")
+}
+
+// WritePairs writes the training pairs as JSONL, one pair per line.
+func WritePairs(w io.Writer, pairs []Pair) error {
+	enc := json.NewEncoder(w)
+	for _, p := range pairs {
+		if err := enc.Encode(JSONPair{In: ToJSON(p.In), Out: ToJSON(p.Out)}); err != nil {
+			return errors.Wrap(err, "Unable to write pair")
+		}
+	}
+	return nil
+}
+
+// ReadPairs reads training pairs written by WritePairs. Blank lines and lines starting with # are ignored, so that the files can be annotated by hand.
+func ReadPairs(r io.Reader) (retVal []Pair, err error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var line int
+	for s.Scan() {
+		line++
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		var p JSONPair
+		if err = json.Unmarshal([]byte(text), &p); err != nil {
+			return nil, errors.Wrapf(err, "Line %d", line)
+		}
+		if len(p.In) == 0 || len(p.Out) == 0 {
+			return nil, errors.Errorf("Line %d: a pair needs both an input and an output", line)
+		}
+		retVal = append(retVal, Pair{In: FromJSON(p.In), Out: FromJSON(p.Out)})
+	}
+	if err = s.Err(); err != nil {
+		return nil, err
+	}
+	return retVal, nil
+}
+
+// ReadPairsFile reads the training pairs of a dataset file. See ReadPairs.
+func ReadPairsFile(filename string) ([]Pair, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadPairs(f)
+}
+
+// Split holds out a random fraction of the pairs, e.g. to compute a validation loss on. The order of the remaining pairs is kept.
+func Split(pairs []Pair, fraction float64, rng *rand.Rand) (train, heldOut []Pair) {
+	n := int(fraction * float64(len(pairs)))
+	held := make(map[int]bool, n)
+	for _, i := range rng.Perm(len(pairs))[:n] {
+		held[i] = true
+	}
+	for i, p := range pairs {
+		if held[i] {
+			heldOut = append(heldOut, p)
+		} else {
+			train = append(train, p)
+		}
+	}
+	return train, heldOut
+}
@@ -0,0 +1,84 @@
+package model
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testPairs(n int) []Pair {
+	pairs := make([]Pair, n)
+	for i := range pairs {
+		pairs[i] = Pair{
+			In:  []Message{{Key: byte(60 + i%12), Duration: 100, Velocity: 90}, {Key: Rest, Duration: 50}},
+			Out: []Message{{Channel: 1, Key: byte(48 + i%12), Duration: uint(100 * (i + 1)), Velocity: 110}},
+		}
+	}
+	return pairs
+}
+
+func TestPairsRoundTrip(t *testing.T) {
+	pairs := testPairs(3)
+	var buf bytes.Buffer
+	if err := WritePairs(&buf, pairs); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadPairs(strings.NewReader("# annotated by hand\n\n" + buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, pairs) {
+		t.Errorf("Got %v. Want %v", got, pairs)
+	}
+}
+
+func TestReadPairsRejects(t *testing.T) {
+	for _, text := range []string{
+		`{"in": [{"key": 60, "duration": 100}]}`,
+		`{"out": [{"key": 60, "duration": 100}]}`,
+		`{"in": [{"key": 60`,
+	} {
+		if _, err := ReadPairs(strings.NewReader(text)); err == nil {
+			t.Errorf("%v: expected an error", text)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	pairs := testPairs(10)
+	train, heldOut := Split(pairs, 0.3, rand.New(rand.NewSource(1)))
+	if len(train) != 7 || len(heldOut) != 3 {
+		t.Fatalf("Got %d training and %d held out pairs. Want 7 and 3", len(train), len(heldOut))
+	}
+
+	// every pair is in one of the two, in its original order
+	index := func(p Pair) int {
+		for i := range pairs {
+			if reflect.DeepEqual(pairs[i], p) {
+				return i
+			}
+		}
+		return -1
+	}
+	seen := make(map[int]bool)
+	for _, part := range [][]Pair{train, heldOut} {
+		prev := -1
+		for _, p := range part {
+			i := index(p)
+			if i <= prev || seen[i] {
+				t.Fatalf("Pair %d is out of order or repeated", i)
+			}
+			seen[i], prev = true, i
+		}
+	}
+
+	train2, heldOut2 := Split(pairs, 0.3, rand.New(rand.NewSource(1)))
+	if !reflect.DeepEqual(train, train2) || !reflect.DeepEqual(heldOut, heldOut2) {
+		t.Error("Expected the same seed to hold out the same pairs")
+	}
+	if train, heldOut := Split(pairs, 0, rand.New(rand.NewSource(1))); len(train) != 10 || len(heldOut) != 0 {
+		t.Errorf("A fraction of 0 held out %d pairs", len(heldOut))
+	}
+}
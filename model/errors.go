@@ -0,0 +1,39 @@
+package model
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// CheckpointError is returned when a checkpoint cannot be saved or loaded.
+type CheckpointError struct {
+	Save bool
+	Err  error
+}
+
+func (e CheckpointError) Error() string {
+	if e.Save {
+		return fmt.Sprintf("Unable to save checkpoint: %v", e.Err)
+	}
+	return fmt.Sprintf("Unable to load checkpoint: %v", e.Err)
+}
+
+// GraphError is returned when the network's graph fails to execute while training or predicting.
+type GraphError struct {
+	Training bool
+	Err      error
+}
+
+func (e GraphError) Error() string {
+	if e.Training {
+		return fmt.Sprintf("Graph failed while training: %v", e.Err)
+	}
+	return fmt.Sprintf("Graph failed while predicting: %v", e.Err)
+}
+
+// Contextual returns the error of the graph's execution with the node and instruction it failed at, if there is one.
+func (e GraphError) Contextual() (ContextualError, bool) {
+	ce, ok := errors.Cause(e.Err).(ContextualError)
+	return ce, ok
+}
@@ -1,10 +1,13 @@
-package main
+// Package model is the sequence to sequence network that learns to respond to a musical phrase:
+// constructing it, training it, saving and loading its weights, and predicting a response.
+package model
 
 import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math/rand"
 	"os"
 
 	"github.com/chewxy/math32"
@@ -14,9 +17,25 @@ import (
 	"gorgonia.org/tensor"
 )
 
+const (
+	// the shape that the deployed checkpoints were trained with
+	EmbeddingSize = 100
+	HiddenSize    = 20
+	maxOut        = 11
+
+	// MaxResponseLength is the most messages that a response can have.
+	MaxResponseLength = 100
+
+	// gradient update stuff
+	l2reg     = 0.000001
+	learnrate = 0.01
+	clipVal   = 5.0
+)
+
 var Float = tensor.Float32
 
-type contextualError interface {
+// ContextualError is the error returned when the graph fails to execute, with the node and instruction it failed at.
+type ContextualError interface {
 	error
 	Node() *Node
 	Value() Value
@@ -122,7 +141,8 @@ func (l *GRU) learnables() []ValueGrad {
 	return retVal
 }
 
-type seq2seq struct {
+// Seq2Seq is the call and response model. A model is not safe for concurrent use: predicting and training both add nodes to, and unbind, its graph.
+type Seq2Seq struct {
 	in           GRU
 	in2          GRU
 	dummyPrev    *Node // (hiddnsize) vector
@@ -147,11 +167,24 @@ type seq2seq struct {
 	durations []uint
 
 	g *ExprGraph
+
+	config Config
+	log    *slog.Logger
 }
 
-// NewS2S creates a new Seq2Seq network. Input size is the size of the embedding. Hidden size is the size of the hidden layer
-func NewS2S(hiddenSize, embSize int, keys []byte, durations []uint) *seq2seq {
+// Config is the shape of a network.
+type Config struct {
+	HiddenSize    int // size of the hidden layers
+	EmbeddingSize int // size of the embedding of a key, and of a duration
+}
+
+// DefaultConfig is the shape of the network that is trained and served.
+var DefaultConfig = Config{HiddenSize: HiddenSize, EmbeddingSize: EmbeddingSize}
+
+// New creates a new Seq2Seq network of the given shape and vocabulary.
+func New(config Config, keys []byte, durations []uint) *Seq2Seq {
 	g := NewGraph()
+	hiddenSize, embSize := config.HiddenSize, config.EmbeddingSize
 
 	keySize := len(keys) + 2
 	durationSize := len(durations) + 2
@@ -183,7 +216,7 @@ func NewS2S(hiddenSize, embSize int, keys []byte, durations []uint) *seq2seq {
 	durOutbedding := NewMatrix(g, Float, WithShape(durationSize, hiddenSize), WithName("Duration Outbedding"), WithInit(GlorotN(1.0)))
 	durOutbedding_b := NewVector(g, Float, WithShape(durationSize), WithName("DurOut bias"), WithInit(Zeroes()))
 
-	return &seq2seq{
+	return &Seq2Seq{
 		in:           in,
 		in2:          in2,
 		dummyPrev:    dummyPrev,
@@ -204,10 +237,40 @@ func NewS2S(hiddenSize, embSize int, keys []byte, durations []uint) *seq2seq {
 		durations: durations,
 
 		g: g,
+
+		config: config,
 	}
 }
 
-func (s *seq2seq) learnables() []ValueGrad {
+// Blank creates a new, untrained, network of the same shape and vocabulary. It logs to the same logger.
+func (s *Seq2Seq) Blank() *Seq2Seq {
+	retVal := New(s.config, s.keys, s.durations)
+	retVal.log = s.log
+	return retVal
+}
+
+// SetLogger sets the logger that training and predicting log to. Nil logs to the default logger.
+func (s *Seq2Seq) SetLogger(l *slog.Logger) { s.log = l }
+
+func (s *Seq2Seq) logger() *slog.Logger {
+	if s.log == nil {
+		return slog.Default()
+	}
+	return s.log
+}
+
+// Release unbinds all the values of the graph so that they can be garbage collected. The network must not be used afterwards.
+func (s *Seq2Seq) Release() { s.g.UnbindAll() }
+
+// Vocabulary returns the keys and durations that the network knows.
+func (s *Seq2Seq) Vocabulary() (keys []byte, durations []uint) { return s.keys, s.durations }
+
+// NewSolver returns the solver that the network is trained with.
+func NewSolver() Solver {
+	return NewRMSPropSolver(WithLearnRate(learnrate), WithL2Reg(l2reg), WithClip(clipVal))
+}
+
+func (s *Seq2Seq) learnables() []ValueGrad {
 	retVal := make([]ValueGrad, 0)
 	retVal = append(retVal, s.in.learnables()...)
 	retVal = append(retVal, s.in2.learnables()...)
@@ -218,8 +281,8 @@ func (s *seq2seq) learnables() []ValueGrad {
 	return retVal
 }
 
-// train trains a pair of input and outputs
-func (s *seq2seq) train(in []message, out []message) (cost *Node, err error) {
+// cost builds the cost of a pair of input and outputs
+func (s *Seq2Seq) cost(in []Message, out []Message) (cost *Node, err error) {
 	var prev, prev2 *Node = s.dummyPrev, s.dummyPrev2
 	for i := -1; i <= len(in); i++ {
 		var keyIn, durIn int
@@ -228,8 +291,8 @@ func (s *seq2seq) train(in []message, out []message) (cost *Node, err error) {
 		} else if i == len(in) {
 			keyIn, durIn = 1, 1
 		} else {
-			keyIn = s.keyLookup[in[i].key] + 2
-			durIn = s.durLookup[in[i].duration] + 2
+			keyIn = s.keyLookup[in[i].Key] + 2
+			durIn = s.durLookup[in[i].Duration] + 2
 		}
 		// log.Printf("KeyIn %v ChIn %v, durIn %v | %v", keyIn, chIn, durIn, s.keyEmbedding.Shape())
 
@@ -252,8 +315,8 @@ func (s *seq2seq) train(in []message, out []message) (cost *Node, err error) {
 		if i == -1 {
 			keyIn, durIn = 0, 0
 		} else {
-			keyIn = s.keyLookup[out[i].key] + 2
-			durIn = s.durLookup[out[i].duration] + 2
+			keyIn = s.keyLookup[out[i].Key] + 2
+			durIn = s.durLookup[out[i].Duration] + 2
 		}
 		// log.Printf("Out KeyIn %v ChIn %v, durIn %v", keyIn, chIn, durIn)
 
@@ -261,8 +324,8 @@ func (s *seq2seq) train(in []message, out []message) (cost *Node, err error) {
 		if i == len(out)-1 {
 			targetKey, targetDur = 1, 1
 		} else {
-			targetKey = s.keyLookup[out[i+1].key] + 2
-			targetDur = s.durLookup[out[i+1].duration] + 2
+			targetKey = s.keyLookup[out[i+1].Key] + 2
+			targetDur = s.durLookup[out[i+1].Duration] + 2
 		}
 
 		// log.Printf("TargetKey %v, TargetCh %v, targetDur %v", targetKey, targetCh, targetDur)
@@ -300,7 +363,61 @@ func (s *seq2seq) train(in []message, out []message) (cost *Node, err error) {
 
 }
 
-func (s *seq2seq) predict(in []message) (output []message, err error) {
+// SampleOptions control how the response is sampled from the network's predictions.
+type SampleOptions struct {
+	Temperature float64    // 0 always picks the most likely key and duration. Higher temperatures give more varied responses
+	MaxLen      int        // maximum number of messages in the response. 0 uses the default. It is capped at MaxResponseLength
+	Rng         *rand.Rand // used when the temperature is above 0. Nil uses the global source
+
+	OnStep func(Probabilities) // called with the predictions for each message of the response, before it is sampled. May be nil
+}
+
+// Probabilities are the network's predictions for one message of a response.
+type Probabilities struct {
+	Keys      map[byte]float32 `json:"keys"`      // probability of each key of the vocabulary
+	Durations map[uint]float32 `json:"durations"` // probability of each duration of the vocabulary
+	End       float32          `json:"end"`       // probability that the response ends here
+}
+
+// probabilities labels the outputs of the network with the vocabulary. The first two outputs are the start and end markers.
+func (s *Seq2Seq) probabilities(keys, durations Value) (p Probabilities, err error) {
+	kp, ok := keys.Data().([]float32)
+	if !ok || len(kp) != len(s.keys)+2 {
+		return p, errors.Errorf("Unexpected key predictions %v", keys.Shape())
+	}
+	dp, ok := durations.Data().([]float32)
+	if !ok || len(dp) != len(s.durations)+2 {
+		return p, errors.Errorf("Unexpected duration predictions %v", durations.Shape())
+	}
+	p = Probabilities{
+		Keys:      make(map[byte]float32, len(s.keys)),
+		Durations: make(map[uint]float32, len(s.durations)),
+		End:       kp[0] + kp[1],
+	}
+	for i, k := range s.keys {
+		p.Keys[k] = kp[i+2]
+	}
+	for i, d := range s.durations {
+		p.Durations[d] = dp[i+2]
+	}
+	return p, nil
+}
+
+// Predict returns the most likely response to the input. The network must not be trained at the same time.
+func (s *Seq2Seq) Predict(in []Message) (output []Message, err error) {
+	return s.PredictWith(in, SampleOptions{})
+}
+
+// PredictWith returns a response to the input, sampled with the given options. The network must not be trained or used by another goroutine at the same time.
+func (s *Seq2Seq) PredictWith(in []Message, opts SampleOptions) (output []Message, err error) {
+	maxLen := opts.MaxLen
+	if maxLen <= 0 {
+		maxLen = maxOut
+	}
+	if maxLen > MaxResponseLength {
+		maxLen = MaxResponseLength
+	}
+	defer s.g.UnbindAllNonInputs()
 	var prev, prev2 *Node = s.dummyPrev, s.dummyPrev2
 	for i := -1; i <= len(in); i++ {
 		var keyIn, durIn int
@@ -311,7 +428,7 @@ func (s *seq2seq) predict(in []message) (output []message, err error) {
 		} else {
 			var minKey int = int((^uint(0)) >> 1)
 			for j, key := range s.keys {
-				diff := int(key) - int(in[i].key)
+				diff := int(key) - int(in[i].Key)
 				sq := diff * diff
 				if sq < minKey {
 					minKey = sq
@@ -321,14 +438,14 @@ func (s *seq2seq) predict(in []message) (output []message, err error) {
 
 			var minDur int = int((^uint(0)) >> 1)
 			for j, dur := range s.durations {
-				diff := int(dur) - int(in[i].duration)
+				diff := int(dur) - int(in[i].Duration)
 				sq := diff * diff
 				if sq < minDur {
 					minDur = sq
 					durIn = j
 				}
 			}
-			log.Printf("Key %v Duration %v. Closest %v", in[i].key, in[i].duration, s.durations[durIn])
+			s.logger().Debug("Input", "key", in[i].Key, "duration", in[i].Duration, "closest", s.durations[durIn])
 			keyIn += 2
 			durIn += 2
 		}
@@ -365,40 +482,52 @@ func (s *seq2seq) predict(in []message) (output []message, err error) {
 		g := s.g.SubgraphRoots(predKey, predDur)
 		machine := NewLispMachine(g, ExecuteFwdOnly())
 		if err = machine.RunAll(); err != nil {
-			log.Printf("FAIL WHILE PREDICTING %d", len(output))
-			return
+			s.logger().Debug("Predicting failed", "step", len(output), "err", err)
+			return nil, GraphError{Err: err}
 		}
 
-		keyID := sample(predKey.Value())
-		durID := sample(predDur.Value())
+		if opts.OnStep != nil {
+			var p Probabilities
+			if p, err = s.probabilities(predKey.Value(), predDur.Value()); err != nil {
+				return nil, GraphError{Err: err}
+			}
+			opts.OnStep(p)
+		}
+
+		var keyID, durID int
+		if keyID, err = sample(predKey.Value(), opts); err != nil {
+			return nil, GraphError{Err: err}
+		}
+		if durID, err = sample(predDur.Value(), opts); err != nil {
+			return nil, GraphError{Err: err}
+		}
 
 		// end
 		if keyID <= 1 || durID < 2 {
 			break
 		}
 
-		msg := message{
-			channel:  1,
-			key:      s.keys[keyID-2],
-			duration: s.durations[durID-2],
+		msg := Message{
+			Channel:  1,
+			Key:      s.keys[keyID-2],
+			Duration: s.durations[durID-2],
 		}
 
 		output = append(output, msg)
 		// count rests
 		var restCount int
 		for _, o := range output {
-			if o.key == 255 {
+			if o.Key == Rest {
 				restCount++
 			}
 		}
 
-		if len(output) >= maxOut {
+		if len(output) >= maxLen {
 			break
 		}
-		keyIn = s.keyLookup[msg.key]
-		durIn = s.durLookup[msg.duration]
+		keyIn = s.keyLookup[msg.Key]
+		durIn = s.durLookup[msg.Duration]
 	}
-	s.g.UnbindAllNonInputs()
 	// log.Printf("ALL NODES %d", len(s.g.AllNodes()))
 	// for _, n := range s.g.AllNodes() {
 	// 	log.Printf("\n%v: %t %t", n, n.IsVar(), n.Value() == nil)
@@ -411,14 +540,10 @@ func (s *seq2seq) predict(in []message) (output []message, err error) {
 	return
 }
 
-func (s *seq2seq) checkpoint() (err error) {
+// Save writes the weights of the network as a checkpoint.
+func (s *Seq2Seq) Save(w io.Writer) (err error) {
 	learnables := s.learnables()
-	var f io.WriteCloser
-	if f, err = os.OpenFile("CHECKPOINT.bin", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644); err != nil {
-		return
-	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
+	enc := json.NewEncoder(w)
 	for _, l := range learnables {
 		t := l.Value().(*tensor.Dense).Data() // []float32
 		if err = enc.Encode(t); err != nil {
@@ -429,14 +554,39 @@ func (s *seq2seq) checkpoint() (err error) {
 	return nil
 }
 
-func (s *seq2seq) load() (err error) {
-	learnables := s.learnables()
+// SaveFile saves a checkpoint to the given file.
+func (s *Seq2Seq) SaveFile(filename string) (err error) {
+	var f io.WriteCloser
+	if f, err = os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644); err != nil {
+		return CheckpointError{Save: true, Err: err}
+	}
+	if err = s.Save(f); err != nil {
+		f.Close()
+		return CheckpointError{Save: true, Err: err}
+	}
+	if err = f.Close(); err != nil {
+		return CheckpointError{Save: true, Err: err}
+	}
+	return nil
+}
+
+// LoadFile loads a checkpoint from the given file.
+func (s *Seq2Seq) LoadFile(filename string) (err error) {
 	var f io.ReadCloser
-	if f, err = os.OpenFile("CHECKPOINT.bin", os.O_RDONLY, 0644); err != nil {
-		return
+	if f, err = os.OpenFile(filename, os.O_RDONLY, 0644); err != nil {
+		return CheckpointError{Err: err}
 	}
 	defer f.Close()
-	dec := json.NewDecoder(f)
+	if err = s.Load(f); err != nil {
+		return CheckpointError{Err: err}
+	}
+	return nil
+}
+
+// Load reads the weights of the network from a checkpoint that was written by Save. The network must have the same shape.
+func (s *Seq2Seq) Load(r io.Reader) (err error) {
+	learnables := s.learnables()
+	dec := json.NewDecoder(r)
 	for _, l := range learnables {
 		t := l.Value().(*tensor.Dense).Data().([]float32)
 		var data []float32
@@ -451,15 +601,24 @@ func (s *seq2seq) load() (err error) {
 	return nil
 }
 
-func train(s *seq2seq, iter int, solver Solver, data []trainingPair) (err error) {
+// EpochStats are the statistics of a training epoch.
+type EpochStats struct {
+	Cost         float32 // average cost of the pairs
+	GradientNorm float32 // average L2 norm of the gradients, before they are clipped
+}
+
+// TrainEpoch trains the network on each of the pairs once, in a random order. io.EOF is returned if the cost is NaN.
+func (s *Seq2Seq) TrainEpoch(iter int, solver Solver, data []Pair) (stats EpochStats, err error) {
 	shuffle(data)
 
-	var avgCost float32
-	for i, pair := range data {
+	var total, norms float32
+	for _, pair := range data {
 		var g *ExprGraph
 		var cost *Node
 		var costVal Value
-		cost, err = s.train(pair.in, pair.out)
+		if cost, err = s.cost(pair.In, pair.Out); err != nil {
+			return stats, GraphError{Training: true, Err: err}
+		}
 		read := Read(cost, &costVal)
 		g = s.g.SubgraphRoots(read)
 
@@ -467,36 +626,71 @@ func train(s *seq2seq, iter int, solver Solver, data []trainingPair) (err error)
 		// m := NewLispMachine(g, WithLogger(logger), LogBothDir(), WithWatchlist())
 		m := NewLispMachine(g)
 		if err = m.RunAll(); err != nil {
-			if ctxError, ok := err.(contextualError); ok {
-				log.Printf("FAIL WHILE TRAINING")
-				log.Printf("Input %v", pair.in)
-				log.Printf("Output %v", pair.out)
-				log.Printf("ERR %+v", ctxError.Err())
+			if ctxError, ok := err.(ContextualError); ok {
+				s.logger().Error("Training failed", "iter", iter, "input", pair.In, "output", pair.Out, "err", fmt.Sprintf("%+v", ctxError.Err()))
 			}
-			return
+			return stats, GraphError{Training: true, Err: err}
 			// ioutil.WriteFile("FAIL.dot", []byte(s.g.ToDot()), 0644)
 			// return
 		}
-		avgCost += costVal.Data().(float32)
-		if math32.IsNaN(avgCost) {
+		total += costVal.Data().(float32)
+		if math32.IsNaN(total) {
 			s.g.UnbindAllNonInputs()
-			return io.EOF
+			return stats, io.EOF
 		}
 
-		if iter == 0 || i == len(data)-1 {
-			avgCost /= float32(len(data))
-			log.Printf("Iter %d. Cost %v", iter, avgCost)
+		learnables := s.learnables()
+		norms += gradientNorm(learnables)
+		if err = solver.Step(learnables); err != nil {
+			return
 		}
+	}
+	if len(data) > 0 {
+		stats.Cost = total / float32(len(data))
+		stats.GradientNorm = norms / float32(len(data))
+	}
+	s.logger().Info("Trained", "iter", iter, "cost", stats.Cost, "gradient_norm", stats.GradientNorm)
+	return stats, nil
 
-		if err = solver.Step(s.learnables()); err != nil {
-			return
+}
+
+// Loss returns the average cost of the pairs, without training on them. It is used to compute the validation loss.
+func (s *Seq2Seq) Loss(data []Pair) (loss float32, err error) {
+	defer s.g.UnbindAllNonInputs()
+	for _, pair := range data {
+		var cost *Node
+		var costVal Value
+		if cost, err = s.cost(pair.In, pair.Out); err != nil {
+			return 0, GraphError{Training: true, Err: err}
 		}
-		if iter%100 == 0 && iter > 0 {
-			if err = s.checkpoint(); err != nil {
-				return
-			}
+		read := Read(cost, &costVal)
+		m := NewLispMachine(s.g.SubgraphRoots(read), ExecuteFwdOnly())
+		if err = m.RunAll(); err != nil {
+			return 0, GraphError{Training: true, Err: err}
 		}
+		loss += costVal.Data().(float32)
 	}
-	return nil
+	if len(data) > 0 {
+		loss /= float32(len(data))
+	}
+	return loss, nil
+}
 
+// gradientNorm returns the L2 norm of all the gradients. Learnables without a gradient are skipped.
+func gradientNorm(learnables []ValueGrad) float32 {
+	var sum float32
+	for _, l := range learnables {
+		grad, err := l.Grad()
+		if err != nil {
+			continue
+		}
+		data, ok := grad.Data().([]float32)
+		if !ok {
+			continue
+		}
+		for _, v := range data {
+			sum += v * v
+		}
+	}
+	return math32.Sqrt(sum)
 }
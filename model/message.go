@@ -0,0 +1,48 @@
+package model
+
+import (
+	"sort"
+
+	"github.com/xtgo/set"
+)
+
+// Rest is the key of a message that is a rest.
+const Rest = 255
+
+// Message is a note or a rest. Durations are in ticks when the message comes from a MIDI file, and in milliseconds when it is played live.
+type Message struct {
+	Channel  byte
+	Key      byte
+	Duration uint
+	Velocity byte // velocity 0 == noteoff
+}
+
+// Pair is a call and the response to it.
+type Pair struct {
+	In, Out []Message
+}
+
+// Vocabulary returns the sorted unique keys and durations of the notes in the training pairs. Rests are not counted.
+func Vocabulary(pairs []Pair) (keys []byte, durations []uint) {
+	for _, p := range pairs {
+		for _, msgs := range [][]Message{p.In, p.Out} {
+			for _, m := range msgs {
+				if m.Key == Rest {
+					continue
+				}
+				keys = append(keys, m.Key)
+				durations = append(durations, m.Duration)
+			}
+		}
+	}
+
+	sort.Sort(byteslice(keys))
+	sort.Sort(uintslice(durations))
+
+	n := set.Uniq(byteslice(keys))
+	keys = keys[:n]
+
+	n = set.Uniq(uintslice(durations))
+	durations = durations[:n]
+	return keys, durations
+}
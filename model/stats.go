@@ -0,0 +1,122 @@
+package model
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// histogramWidth is the width of the longest bar in a printed histogram
+const histogramWidth = 50
+
+// Stats are statistics about a set of training pairs, used to find problems with the training data.
+type Stats struct {
+	pairs      int
+	keys       map[int]int // rests are counted as 255
+	durations  map[int]int
+	inLengths  map[int]int
+	outLengths map[int]int
+
+	emptyIn    int // pairs with no notes in the input
+	emptyOut   int // pairs with no notes in the output
+	zeroLength int // notes with a duration of 0
+	outliers   int // notes or rests longer than the outlier threshold
+
+	// only available when the statistics are collected from a MIDI file
+	UnmatchedOn  int
+	UnmatchedOff int
+}
+
+// LintThresholds are the maximum number of each kind of problem that is tolerated. A negative number disables the check.
+type LintThresholds struct {
+	Unmatched  int
+	ZeroLength int
+	Outliers   int
+	Empty      int
+}
+
+// CollectStats collects the statistics of the pairs. Durations longer than outlier are counted as outliers.
+func CollectStats(pairs []Pair, outlier uint) *Stats {
+	s := &Stats{
+		pairs:      len(pairs),
+		keys:       make(map[int]int),
+		durations:  make(map[int]int),
+		inLengths:  make(map[int]int),
+		outLengths: make(map[int]int),
+	}
+	for _, p := range pairs {
+		s.inLengths[len(p.In)]++
+		s.outLengths[len(p.Out)]++
+		if !hasNotes(p.In) {
+			s.emptyIn++
+		}
+		if !hasNotes(p.Out) {
+			s.emptyOut++
+		}
+		for _, msgs := range [][]Message{p.In, p.Out} {
+			for _, m := range msgs {
+				s.keys[int(m.Key)]++
+				s.durations[int(m.Duration)]++
+				if m.Key != Rest && m.Duration == 0 {
+					s.zeroLength++
+				}
+				if m.Duration > outlier {
+					s.outliers++
+				}
+			}
+		}
+	}
+	return s
+}
+
+// Lint returns a list of the thresholds that are exceeded.
+func (s *Stats) Lint(t LintThresholds) (problems []string) {
+	check := func(name string, count, max int) {
+		if max >= 0 && count > max {
+			problems = append(problems, fmt.Sprintf("%d %s (max %d)", count, name, max))
+		}
+	}
+	check("unmatched NoteOn/NoteOff", s.UnmatchedOn+s.UnmatchedOff, t.Unmatched)
+	check("zero length notes", s.zeroLength, t.ZeroLength)
+	check("outlier durations", s.outliers, t.Outliers)
+	check("pairs with an empty side", s.emptyIn+s.emptyOut, t.Empty)
+	return problems
+}
+
+// Report writes the statistics and their histograms.
+func (s *Stats) Report(w io.Writer) {
+	fmt.Fprintf(w, "Pairs: %d\n", s.pairs)
+	fmt.Fprintf(w, "Pairs with no input notes: %d\n", s.emptyIn)
+	fmt.Fprintf(w, "Pairs with no output notes: %d\n", s.emptyOut)
+	fmt.Fprintf(w, "Zero length notes: %d\n", s.zeroLength)
+	fmt.Fprintf(w, "Outlier durations: %d\n", s.outliers)
+	fmt.Fprintf(w, "Unmatched NoteOn: %d\n", s.UnmatchedOn)
+	fmt.Fprintf(w, "Unmatched NoteOff: %d\n", s.UnmatchedOff)
+
+	fmt.Fprintf(w, "\nKeys (255 is a rest):\n")
+	printHistogram(w, s.keys)
+	fmt.Fprintf(w, "\nDurations:\n")
+	printHistogram(w, s.durations)
+	fmt.Fprintf(w, "\nInput lengths:\n")
+	printHistogram(w, s.inLengths)
+	fmt.Fprintf(w, "\nOutput lengths:\n")
+	printHistogram(w, s.outLengths)
+}
+
+func printHistogram(w io.Writer, counts map[int]int) {
+	var buckets []int
+	var max int
+	for b, c := range counts {
+		buckets = append(buckets, b)
+		if c > max {
+			max = c
+		}
+	}
+	sort.Ints(buckets)
+	for _, b := range buckets {
+		c := counts[b]
+		bar := (c*histogramWidth + max - 1) / max
+		fmt.Fprintf(w, "%8d %6d %s\n", b, c, strings.Repeat("#", bar))
+	}
+}
@@ -0,0 +1,94 @@
+package model
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	note := func(key byte, dur uint) Message { return Message{Key: key, Duration: dur, Velocity: 100} }
+	ok := Pair{In: []Message{note(60, 100)}, Out: []Message{note(62, 200)}}
+	none := LintThresholds{Unmatched: -1, ZeroLength: -1, Outliers: -1, Empty: -1}
+	tests := []struct {
+		name      string
+		pairs     []Pair
+		unmatched int
+		limits    func(t *LintThresholds)
+		want      []string
+	}{
+		{
+			name:   "clean",
+			pairs:  []Pair{ok},
+			limits: func(t *LintThresholds) { *t = LintThresholds{} },
+		},
+		{
+			name:      "unmatched",
+			pairs:     []Pair{ok},
+			unmatched: 2,
+			limits:    func(t *LintThresholds) { t.Unmatched = 1 },
+			want:      []string{"2 unmatched NoteOn/NoteOff (max 1)"},
+		},
+		{
+			name:   "zero length",
+			pairs:  []Pair{ok, {In: []Message{note(60, 0), note(Rest, 0)}, Out: []Message{note(62, 100)}}},
+			limits: func(t *LintThresholds) { t.ZeroLength = 0 },
+			want:   []string{"1 zero length notes (max 0)"},
+		},
+		{
+			name:   "outliers",
+			pairs:  []Pair{ok, {In: []Message{note(60, 5000)}, Out: []Message{note(Rest, 6000), note(62, 100)}}},
+			limits: func(t *LintThresholds) { t.Outliers = 1 },
+			want:   []string{"2 outlier durations (max 1)"},
+		},
+		{
+			name:   "empty",
+			pairs:  []Pair{ok, {In: []Message{note(Rest, 100)}, Out: []Message{note(62, 100)}}, {In: []Message{note(60, 100)}}},
+			limits: func(t *LintThresholds) { t.Empty = 1 },
+			want:   []string{"2 pairs with an empty side (max 1)"},
+		},
+		{
+			name:   "at the threshold",
+			pairs:  []Pair{ok, {In: []Message{note(60, 0)}, Out: []Message{note(62, 100)}}},
+			limits: func(t *LintThresholds) { t.ZeroLength = 1 },
+		},
+		{
+			name:      "everything",
+			pairs:     []Pair{{In: []Message{note(60, 0)}, Out: []Message{note(62, 5000)}}, {In: []Message{note(60, 100)}}},
+			unmatched: 1,
+			limits:    func(t *LintThresholds) { *t = LintThresholds{} },
+			want: []string{
+				"1 unmatched NoteOn/NoteOff (max 0)",
+				"1 zero length notes (max 0)",
+				"1 outlier durations (max 0)",
+				"1 pairs with an empty side (max 0)",
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := CollectStats(tc.pairs, 1000)
+			s.UnmatchedOn = tc.unmatched
+			limits := none
+			tc.limits(&limits)
+			if got := s.Lint(limits); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Got %q. Want %q", got, tc.want)
+			}
+			if got := s.Lint(none); got != nil {
+				t.Errorf("Disabled checks found %q", got)
+			}
+		})
+	}
+}
+
+func TestReport(t *testing.T) {
+	pairs := []Pair{{In: []Message{{Key: 60, Duration: 100}, {Key: 60, Duration: 0}}, Out: []Message{{Key: 62, Duration: 100}}}}
+	var buf bytes.Buffer
+	CollectStats(pairs, 1000).Report(&buf)
+	for _, want := range []string{"Pairs: 1\n", "Zero length notes: 1\n", "      60      2 ", "     100      2 "} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected %q in the report:\n%v", want, buf.String())
+		}
+	}
+}
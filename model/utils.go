@@ -0,0 +1,87 @@
+package model
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/pkg/errors"
+
+	"gorgonia.org/gorgonia"
+	"gorgonia.org/tensor"
+)
+
+// sample picks an index from a probability distribution. At a temperature of 0 the most likely index is picked.
+func sample(val gorgonia.Value, opts SampleOptions) (int, error) {
+	// var t tensor.Tensor
+	// var ok bool
+	// if t, ok = val.(tensor.Tensor); !ok {
+	// 	panic("Expects a tensor")
+	// }
+
+	// return tensor.SampleIndex(t)
+
+	var t tensor.Tensor
+	var ok bool
+	if t, ok = val.(tensor.Tensor); !ok {
+		return -1, errors.Errorf("Expected a tensor. Got %T", val)
+	}
+	if opts.Temperature > 0 {
+		return sampleTemperature(t, opts)
+	}
+	indT, err := tensor.Argmax(t, -1)
+	if err != nil {
+		return -1, errors.Wrap(err, "Unable to sample")
+	}
+	if !indT.IsScalar() {
+		return -1, errors.Errorf("Expected scalar index. Got shape %v", indT.Shape())
+	}
+	return indT.ScalarValue().(int), nil
+}
+
+// sampleTemperature draws an index from the distribution, reshaped by the temperature: p^(1/T), normalized.
+func sampleTemperature(t tensor.Tensor, opts SampleOptions) (int, error) {
+	probs, ok := t.Data().([]float32)
+	if !ok || len(probs) == 0 {
+		return -1, errors.Errorf("Expected a []float32 distribution. Got %T", t.Data())
+	}
+	weights := make([]float64, len(probs))
+	var sum float64
+	for i, p := range probs {
+		weights[i] = math.Pow(float64(p), 1/opts.Temperature)
+		sum += weights[i]
+	}
+	if sum == 0 || math.IsNaN(sum) || math.IsInf(sum, 0) {
+		return -1, errors.Errorf("Unable to sample at temperature %v", opts.Temperature)
+	}
+
+	r := rand.Float64
+	if opts.Rng != nil {
+		r = opts.Rng.Float64
+	}
+	x := r() * sum
+	for i, w := range weights {
+		if x -= w; x < 0 {
+			return i, nil
+		}
+	}
+	return len(weights) - 1, nil
+}
+
+func shuffle(a []Pair) {
+	for i := len(a) - 1; i > 0; i-- {
+		j := rand.Intn(i + 1)
+		a[i], a[j] = a[j], a[i]
+	}
+}
+
+type byteslice []byte
+
+func (s byteslice) Len() int           { return len(s) }
+func (s byteslice) Less(i, j int) bool { return s[i] < s[j] }
+func (s byteslice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type uintslice []uint
+
+func (s uintslice) Len() int           { return len(s) }
+func (s uintslice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uintslice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,78 @@
+package model
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"gorgonia.org/tensor"
+)
+
+// Weights is a copy of the learnables of a model. It must not be modified once it is published.
+type Weights struct {
+	Version int
+	Data    [][]float32
+}
+
+// Snapshot copies the model's learnables.
+func (s *Seq2Seq) Snapshot() [][]float32 {
+	learnables := s.learnables()
+	retVal := make([][]float32, len(learnables))
+	for i, l := range learnables {
+		t := l.Value().(*tensor.Dense).Data().([]float32)
+		retVal[i] = make([]float32, len(t))
+		copy(retVal[i], t)
+	}
+	return retVal
+}
+
+// Restore copies the data of a snapshot into the model's learnables. The model must have the same shape as the one the snapshot was taken of.
+func (s *Seq2Seq) Restore(data [][]float32) error {
+	learnables := s.learnables()
+	if len(data) != len(learnables) {
+		return errors.Errorf("Snapshot has %d learnables. Expected %d", len(data), len(learnables))
+	}
+	for i, l := range learnables {
+		t := l.Value().(*tensor.Dense).Data().([]float32)
+		if len(data[i]) != len(t) {
+			return errors.Errorf("Learnable %d has length %d. Expected length %d", i, len(data[i]), len(t))
+		}
+		copy(t, data[i])
+	}
+	return nil
+}
+
+// Holder holds the latest weights published by the training loop. It is safe for concurrent use.
+type Holder struct {
+	sync.Mutex
+	current *Weights
+}
+
+// Publish makes a snapshot the latest weights. The snapshot must not be modified afterwards.
+func (h *Holder) Publish(data [][]float32) {
+	h.Lock()
+	defer h.Unlock()
+	version := 1
+	if h.current != nil {
+		version = h.current.Version + 1
+	}
+	h.current = &Weights{Version: version, Data: data}
+}
+
+// Latest returns the latest weights, or nil if nothing has been published.
+func (h *Holder) Latest() *Weights {
+	h.Lock()
+	defer h.Unlock()
+	return h.current
+}
+
+// Update restores the latest weights into the model if they are newer than version, and returns the version the model is at.
+func (h *Holder) Update(s *Seq2Seq, version int) (int, error) {
+	w := h.Latest()
+	if w == nil || w.Version == version {
+		return version, nil
+	}
+	if err := s.Restore(w.Data); err != nil {
+		return version, err
+	}
+	return w.Version, nil
+}
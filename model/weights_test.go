@@ -0,0 +1,73 @@
+package model
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentTrainAndPredict trains a model while a blank copy of it predicts with the weights that the training publishes.
+// The two must not share any state, which go test -race checks.
+func TestConcurrentTrainAndPredict(t *testing.T) {
+	pairs := []Pair{
+		{
+			In:  []Message{{Key: 60, Duration: 100}, {Key: 62, Duration: 200}},
+			Out: []Message{{Channel: 1, Key: 64, Duration: 100}},
+		},
+		{
+			In:  []Message{{Key: 64, Duration: 200}},
+			Out: []Message{{Channel: 1, Key: 60, Duration: 200}, {Channel: 1, Key: 62, Duration: 100}},
+		},
+	}
+	calls := [][]Message{pairs[0].In, pairs[1].In} // training shuffles the pairs
+	keys, durations := Vocabulary(pairs)
+	trained := New(Config{HiddenSize: 8, EmbeddingSize: 4}, keys, durations)
+	trained.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	player := trained.Blank()
+	var h Holder
+	h.Publish(trained.Snapshot())
+
+	const iters = 20
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		solver := NewSolver()
+		for i := 0; i < iters; i++ {
+			if _, err := trained.TrainEpoch(i, solver, pairs); err != nil {
+				t.Errorf("Epoch %d: %v", i, err)
+				return
+			}
+			h.Publish(trained.Snapshot())
+		}
+	}()
+
+	var version, predictions int
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		var err error
+		if version, err = h.Update(player, version); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := player.Predict(calls[predictions%len(calls)]); err != nil {
+			t.Fatal(err)
+		}
+		predictions++
+	}
+	wg.Wait()
+
+	version, err := h.Update(player, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest := h.Latest().Version; version != latest {
+		t.Errorf("The player is at version %d. Expected the last published version %d", version, latest)
+	}
+}
@@ -0,0 +1,233 @@
+// Package server answers call and response requests over HTTP, so that the model can be driven by other tools without a MIDI device.
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chewxy/gopherconsg2018/metrics"
+	"github.com/chewxy/gopherconsg2018/midiio"
+	"github.com/chewxy/gopherconsg2018/model"
+	"github.com/gomidi/midi/smf"
+	"github.com/pkg/errors"
+)
+
+// phrases are exchanged in milliseconds, like the live session. MIDI files are written at a resolution where a tick is a millisecond
+const (
+	midiBPM        = 120
+	midiResolution = smf.MetricTicks(500)
+
+	maxUpload = 1 << 20
+)
+
+// Server predicts responses to the phrases that are posted to it. Each request is handled by one of a fixed number of copies of the model,
+// so that requests are answered concurrently without sharing a graph.
+type Server struct {
+	models chan *model.Seq2Seq
+	parts  midiio.PartMap
+	mux    *http.ServeMux
+}
+
+// New creates a server with the given number of copies of the model. The call parts of the part map are read from uploaded MIDI files.
+func New(s2s *model.Seq2Seq, workers int, parts midiio.PartMap) (*Server, error) {
+	if workers < 1 {
+		return nil, errors.Errorf("Need at least one worker. Got %d", workers)
+	}
+	weights := s2s.Snapshot()
+	s := &Server{
+		models: make(chan *model.Seq2Seq, workers),
+		parts:  parts,
+		mux:    http.NewServeMux(),
+	}
+	for i := 0; i < workers; i++ {
+		m := s2s.Blank()
+		if err := m.Restore(weights); err != nil {
+			return nil, err
+		}
+		s.models <- m
+	}
+	s.mux.HandleFunc("/predict", s.predict)
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) { s.mux.ServeHTTP(w, r) }
+
+// predict responds to a phrase. The phrase is either a JSON list of messages (or a JSON object with the list in "in", like a line of a dataset),
+// or a MIDI file, posted as the body or as the "file" field of a form. MIDI files may be at any tempo, but it must not change.
+// The response is in the same format as the request, unless the format query parameter asks for "json" or "midi".
+//
+// The sampling options are query parameters: temperature (0 picks the most likely notes), maxlen, and seed (for repeatable sampling).
+func (s *Server) predict(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST a phrase to predict a response", http.StatusMethodNotAllowed)
+		return
+	}
+	opts, err := sampleOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
+	in, isMIDI, err := s.readPhrase(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(in) == 0 {
+		http.Error(w, "The phrase has no notes", http.StatusBadRequest)
+		return
+	}
+	switch r.URL.Query().Get("format") {
+	case "":
+	case "json":
+		isMIDI = false
+	case "midi":
+		isMIDI = true
+	default:
+		http.Error(w, "Unknown format. Expected json or midi", http.StatusBadRequest)
+		return
+	}
+
+	var m *model.Seq2Seq
+	select {
+	case m = <-s.models:
+	case <-r.Context().Done():
+		return
+	}
+	start := time.Now()
+	out, err := m.PredictWith(in, opts)
+	s.models <- m
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	metrics.PredictLatency.ObserveDuration(time.Since(start))
+	metrics.CallLength.Observe(float64(len(in)))
+	metrics.ResponseLength.Observe(float64(len(out)))
+
+	if isMIDI {
+		var buf bytes.Buffer
+		if err := writeMIDI(&buf, out); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "audio/midi")
+		w.Header().Set("Content-Disposition", `attachment; filename="response.mid"`)
+		w.Write(buf.Bytes())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(model.ToJSON(out))
+}
+
+// sampleOptions reads the sampling options from the query.
+func sampleOptions(r *http.Request) (opts model.SampleOptions, err error) {
+	q := r.URL.Query()
+	if v := q.Get("temperature"); v != "" {
+		if opts.Temperature, err = strconv.ParseFloat(v, 64); err != nil || opts.Temperature < 0 {
+			return opts, errors.Errorf("%q is not a valid temperature", v)
+		}
+	}
+	if v := q.Get("maxlen"); v != "" {
+		if opts.MaxLen, err = strconv.Atoi(v); err != nil || opts.MaxLen < 1 {
+			return opts, errors.Errorf("%q is not a valid maxlen", v)
+		}
+		if opts.MaxLen > model.MaxResponseLength {
+			return opts, errors.Errorf("maxlen %d is out of range. Expected at most %d", opts.MaxLen, model.MaxResponseLength)
+		}
+	}
+	if v := q.Get("seed"); v != "" {
+		var seed int64
+		if seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return opts, errors.Errorf("%q is not a valid seed", v)
+		}
+		opts.Rng = rand.New(rand.NewSource(seed))
+	}
+	return opts, nil
+}
+
+// readPhrase reads the phrase of the request, and whether it was a MIDI file.
+func (s *Server) readPhrase(r *http.Request) (in []model.Message, isMIDI bool, err error) {
+	typ, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch typ {
+	case "application/json", "":
+		in, err = readJSON(r.Body)
+		return in, false, err
+	case "multipart/form-data":
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, true, errors.Wrap(err, "Expected a MIDI file in the file field")
+		}
+		defer f.Close()
+		in, err = s.readMIDI(f)
+		return in, true, err
+	case "audio/midi", "audio/x-midi", "application/octet-stream":
+		in, err = s.readMIDI(r.Body)
+		return in, true, err
+	}
+	return nil, false, errors.Errorf("Unsupported content type %q. Expected application/json, audio/midi or multipart/form-data", typ)
+}
+
+// readJSON reads a phrase that is either a list of messages, or an object with the list in "in".
+func readJSON(r io.Reader) ([]model.Message, error) {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	body = bytes.TrimSpace(body)
+
+	var msgs []model.JSONMessage
+	if len(body) > 0 && body[0] == '{' {
+		var p model.JSONPair
+		err = json.Unmarshal(body, &p)
+		msgs = p.In
+	} else {
+		err = json.Unmarshal(body, &msgs)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to parse phrase")
+	}
+	for i, m := range msgs {
+		if m.Key > 127 && m.Key != model.Rest {
+			return nil, errors.Errorf("Message %d: %d is not a valid key", i, m.Key)
+		}
+	}
+	return model.FromJSON(msgs), nil
+}
+
+// readMIDI reads the call parts of a MIDI file as a phrase, with the durations converted to milliseconds at the tempo of the file.
+func (s *Server) readMIDI(r io.Reader) ([]model.Message, error) {
+	d := midiio.NewDecoder(s.parts)
+	if err := d.Read(r); err != nil {
+		return nil, errors.Wrap(err, "Unable to read MIDI file")
+	}
+	bpm, err := d.Tempo()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read MIDI file")
+	}
+	msgs := d.Call()
+	perMinute := uint64(bpm) * uint64(d.Resolution().Ticks4th()) // ticks
+	for i := range msgs {
+		msgs[i].Duration = uint(uint64(msgs[i].Duration) * uint64(time.Minute/time.Millisecond) / perMinute)
+	}
+	return msgs, nil
+}
+
+// writeMIDI writes the response as a MIDI file with a single track.
+func writeMIDI(w io.Writer, msgs []model.Message) error {
+	settings := midiio.DefaultExportSettings()
+	settings.Resolution = midiResolution
+	settings.BPM = midiBPM
+	settings.LeadIn = 0
+	settings.Tracks = settings.Tracks[1:]
+	return midiio.WriteMIDI(w, []midiio.Phrase{{Role: midiio.ResponseRole, Msgs: msgs}}, settings)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chewxy/gopherconsg2018/midiio"
+	"github.com/chewxy/gopherconsg2018/model"
+	"github.com/gomidi/midi/midimessage/channel"
+	"github.com/gomidi/midi/midimessage/meta"
+	"github.com/gomidi/midi/smf"
+	"github.com/gomidi/midi/smf/smftrack"
+)
+
+// zeroResolution is a SMF1 file with a resolution of 0 ticks per quarter note. Its second track plays key 60 on channel 0.
+const zeroResolution = "MThd\x00\x00\x00\x06\x00\x01\x00\x02\x00\x00" +
+	"MTrk\x00\x00\x00\x04" + "\x00\xff\x2f\x00" +
+	"MTrk\x00\x00\x00\x0c" + "\x00\x90\x3c\x64" + "\x60\x80\x3c\x00" + "\x00\xff\x2f\x00"
+
+// midiFile is a SMF1 file at 480 ticks per quarter note, with the given tempos at the start of the first track.
+// The second track plays key 60 for a quarter note and then key 62 for an eighth note on channel 0.
+func midiFile(t *testing.T, bpms ...uint32) string {
+	t.Helper()
+	conductor := smftrack.New(0)
+	for _, bpm := range bpms {
+		conductor.AddEvents(smftrack.Event{Message: meta.Tempo(bpm)})
+	}
+	notes := smftrack.New(1)
+	ch := channel.Channel0
+	notes.AddEvents(
+		smftrack.Event{AbsTicks: 0, Message: ch.NoteOn(60, 100)}, smftrack.Event{AbsTicks: 480, Message: ch.NoteOff(60)},
+		smftrack.Event{AbsTicks: 480, Message: ch.NoteOn(62, 100)}, smftrack.Event{AbsTicks: 720, Message: ch.NoteOff(62)},
+	)
+	var buf bytes.Buffer
+	if _, err := (smftrack.SMF1{}).WriteTo(&buf, smf.MetricTicks(480), conductor, notes); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// form posts a MIDI file as the file field of a form
+func form(t *testing.T, file string) (contentType, body string) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	f, err := w.CreateFormFile("file", "call.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(file))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return w.FormDataContentType(), buf.String()
+}
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	parts, err := midiio.NewPartMap([]int{0}, []int{1}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2s := model.New(model.Config{HiddenSize: 8, EmbeddingSize: 4}, []byte{60, 62, 64}, []uint{100, 200})
+	s, err := New(s2s, 1, parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestPredict(t *testing.T) {
+	s := newTestServer(t)
+	phrase := `[{"key": 60, "duration": 100}, {"key": 62, "duration": 200}]`
+	formType, formBody := form(t, midiFile(t))
+	tests := []struct {
+		name        string
+		query       string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"json", "", "application/json", phrase, http.StatusOK},
+		{"longest response", "?maxlen=100", "application/json", phrase, http.StatusOK},
+		{"response too long", "?maxlen=101", "application/json", phrase, http.StatusBadRequest},
+		{"no maxlen", "?maxlen=0", "application/json", phrase, http.StatusBadRequest},
+		{"no notes", "", "application/json", `[]`, http.StatusBadRequest},
+		{"MIDI file", "", "audio/midi", midiFile(t, 90), http.StatusOK},
+		{"MIDI file in a form", "", formType, formBody, http.StatusOK},
+		{"MIDI file without a resolution", "", "audio/midi", zeroResolution, http.StatusBadRequest},
+		{"MIDI file with tempo changes", "", "audio/midi", midiFile(t, 90, 120), http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/predict"+tc.query, strings.NewReader(tc.body))
+			r.Header.Set("Content-Type", tc.contentType)
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("Got status %d (%q). Want %d", w.Code, strings.TrimSpace(w.Body.String()), tc.want)
+			}
+		})
+	}
+}
+
+func TestReadMIDI(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		name string
+		bpms []uint32
+		want []uint // ms
+	}{
+		{"no tempo is 120 BPM", nil, []uint{500, 250}},
+		{"60 BPM", []uint32{60}, []uint{1000, 500}},
+		{"150 BPM", []uint32{150}, []uint{400, 200}},
+		{"the same tempo twice", []uint32{60, 60}, []uint{1000, 500}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs, err := s.readMIDI(strings.NewReader(midiFile(t, tc.bpms...)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []uint
+			for _, m := range msgs {
+				got = append(got, m.Duration)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Got durations of %vms. Want %vms", got, tc.want)
+			}
+		})
+	}
+}
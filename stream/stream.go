@@ -0,0 +1,198 @@
+// Package stream publishes what happens in a live session (notes, phrases and predictions) to WebSocket clients,
+// so that visualisations can run in a browser instead of the OpenGL window.
+package stream
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chewxy/gopherconsg2018/midiio"
+	"github.com/chewxy/gopherconsg2018/model"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	bufferedEvents = 256 // events that are buffered for each client. A client that falls further behind misses events
+	writeWait      = 5 * time.Second
+	pingPeriod     = 30 * time.Second
+)
+
+// event types
+const (
+	NoteEvent       = "note"
+	PhraseEvent     = "phrase"
+	PredictionEvent = "prediction"
+)
+
+// sources of notes and phrases
+const (
+	Human   = "human"
+	Machine = "machine"
+)
+
+// Event is a JSON message that is sent to the clients.
+type Event struct {
+	Type   string    `json:"type"` // note, phrase or prediction
+	Time   time.Time `json:"time"`
+	Source string    `json:"source,omitempty"` // human or machine. Not set for predictions
+
+	Note        *model.JSONMessage   `json:"note,omitempty"`   // a NoteOn, or a NoteOff if the velocity is 0
+	Phrase      []model.JSONMessage  `json:"phrase,omitempty"` // the player's phrase when it ends, or the machine's response when it starts
+	Predictions *model.Probabilities `json:"predictions,omitempty"`
+}
+
+// Hub sends the events that are published to it to all the clients that are connected. It is safe to use from multiple goroutines.
+//
+// Browsers may only connect from pages that are served by the hub's own host, or from the pages of Origins.
+type Hub struct {
+	Origins []string // origins such as http://localhost:8000 that may connect too. "null" is a page opened from a file, and "*" is any page
+
+	sync.Mutex
+	clients map[chan Event]struct{}
+	closed  bool
+}
+
+// NewHub creates a hub with no clients.
+func NewHub() *Hub {
+	return &Hub{clients: make(map[chan Event]struct{})}
+}
+
+// Publish sends an event to all the clients. It never blocks: clients that are too slow miss the event.
+func (h *Hub) Publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	h.Lock()
+	defer h.Unlock()
+	for c := range h.clients {
+		select {
+		case c <- ev:
+		default:
+		}
+	}
+}
+
+// Note publishes a note that the player or the machine started or stopped.
+func (h *Hub) Note(msg model.Message, machine bool) {
+	m := model.ToJSON([]model.Message{msg})[0]
+	h.Publish(Event{Type: NoteEvent, Source: source(machine), Note: &m})
+}
+
+// Phrase publishes the player's phrase (the call) or the machine's response.
+func (h *Hub) Phrase(role midiio.Role, msgs []model.Message) {
+	h.Publish(Event{Type: PhraseEvent, Source: source(role == midiio.ResponseRole), Phrase: model.ToJSON(msgs)})
+}
+
+// Predict publishes the predictions for a message of the machine's response.
+func (h *Hub) Predict(p model.Probabilities) {
+	h.Publish(Event{Type: PredictionEvent, Predictions: &p})
+}
+
+func source(machine bool) string {
+	if machine {
+		return Machine
+	}
+	return Human
+}
+
+// Subscribe adds a client. The events are sent on the returned channel until cancel is called, or the channel is closed when the hub is closed.
+func (h *Hub) Subscribe() (events <-chan Event, cancel func()) {
+	c := make(chan Event, bufferedEvents)
+	h.Lock()
+	if h.closed {
+		close(c)
+	} else {
+		h.clients[c] = struct{}{}
+	}
+	h.Unlock()
+	return c, func() {
+		h.Lock()
+		delete(h.clients, c)
+		h.Unlock()
+	}
+}
+
+// Close disconnects all the clients. Events that are published afterwards are dropped.
+func (h *Hub) Close() error {
+	h.Lock()
+	defer h.Unlock()
+	for c := range h.clients {
+		close(c)
+		delete(h.clients, c)
+	}
+	h.closed = true
+	return nil
+}
+
+// checkOrigin allows requests that are not from a browser, requests from the hub's own host, and requests from the allowed origins.
+func (h *Hub) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range h.Origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// ServeHTTP upgrades the request to a WebSocket, and sends the events to it as JSON text messages until the client goes away.
+// Anything that the client sends is ignored.
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     h.checkOrigin,
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // the upgrader has already replied
+	}
+	defer conn.Close()
+
+	events, cancel := h.Subscribe()
+	defer cancel()
+
+	// read (and drop) the client's messages, so that control messages are handled and we find out when it goes away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		conn.SetReadLimit(512)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(pingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "session over")
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteJSON(ev); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package stream
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chewxy/gopherconsg2018/model"
+)
+
+// next returns the next event of a client, or fails if there is none.
+func next(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatal("The client was disconnected")
+		}
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("No event")
+	}
+	return Event{}
+}
+
+func TestHub(t *testing.T) {
+	h := NewHub()
+	first, cancelFirst := h.Subscribe()
+	second, cancelSecond := h.Subscribe()
+	defer cancelSecond()
+
+	h.Note(model.Message{Key: 60, Velocity: 100}, false)
+	for _, events := range []<-chan Event{first, second} {
+		if ev := next(t, events); ev.Type != NoteEvent || ev.Source != Human || ev.Note.Key != 60 || ev.Time.IsZero() {
+			t.Errorf("Unexpected event %+v", ev)
+		}
+	}
+
+	cancelFirst()
+	h.Predict(model.Probabilities{End: 0.5})
+	if ev := next(t, second); ev.Type != PredictionEvent || ev.Predictions.End != 0.5 {
+		t.Errorf("Unexpected event %+v", ev)
+	}
+	select {
+	case ev := <-first:
+		t.Errorf("Got %+v after unsubscribing", ev)
+	default:
+	}
+
+	h.Close()
+	if _, ok := <-second; ok {
+		t.Error("Expected the clients to be disconnected when the hub is closed")
+	}
+	late, cancel := h.Subscribe()
+	defer cancel()
+	if _, ok := <-late; ok {
+		t.Error("Expected clients that subscribe after the hub is closed to be disconnected")
+	}
+	h.Note(model.Message{Key: 62}, true) // dropped
+}
+
+func TestHubDropsEventsOfSlowClients(t *testing.T) {
+	h := NewHub()
+	events, cancel := h.Subscribe()
+	defer cancel()
+	for i := 0; i < bufferedEvents+10; i++ {
+		h.Note(model.Message{Key: byte(i % 128)}, true)
+	}
+	if len(events) != bufferedEvents {
+		t.Errorf("%d events are buffered. Want %d", len(events), bufferedEvents)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		origin  string
+		allowed []string
+		want    bool
+	}{
+		{"", nil, true},
+		{"http://localhost:8081", nil, true},
+		{"http://evil.example", nil, false},
+		{"null", nil, false},
+		{"http://localhost:8000", []string{"http://localhost:8000"}, true},
+		{"http://localhost:8000", []string{"http://localhost:9000"}, false},
+		{"null", []string{"null"}, true},
+		{"http://evil.example", []string{"*"}, true},
+	}
+	for _, tc := range tests {
+		h := NewHub()
+		h.Origins = tc.allowed
+		r := httptest.NewRequest("GET", "http://localhost:8081/events", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if got := h.checkOrigin(r); got != tc.want {
+			t.Errorf("Origin %q allowing %v: got %t. Want %t", tc.origin, tc.allowed, got, tc.want)
+		}
+	}
+}
@@ -1,51 +1,34 @@
 package main
 
 import (
-	"math/rand"
+	"strconv"
+	"strings"
 
-	"gorgonia.org/gorgonia"
-	"gorgonia.org/tensor"
+	"github.com/pkg/errors"
 )
 
-func sample(val gorgonia.Value) int {
-	// var t tensor.Tensor
-	// var ok bool
-	// if t, ok = val.(tensor.Tensor); !ok {
-	// 	panic("Expects a tensor")
-	// }
-
-	// return tensor.SampleIndex(t)
-
-	var t tensor.Tensor
-	var ok bool
-	if t, ok = val.(tensor.Tensor); !ok {
-		panic("expects a tensor")
-	}
-	indT, err := tensor.Argmax(t, -1)
-	if err != nil {
-		panic(err)
-	}
-	if !indT.IsScalar() {
-		panic("Expected scalar index")
+// parseInts parses a comma separated list of integers. Empty entries are ignored.
+func parseInts(list string) (retVal []int, err error) {
+	for _, f := range strings.Split(list, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		var i int
+		if i, err = strconv.Atoi(f); err != nil {
+			return nil, errors.Wrapf(err, "Unable to parse %q", f)
+		}
+		retVal = append(retVal, i)
 	}
-	return indT.ScalarValue().(int)
+	return retVal, nil
 }
 
-func shuffle(a []trainingPair) {
-	for i := len(a) - 1; i > 0; i-- {
-		j := rand.Intn(i + 1)
-		a[i], a[j] = a[j], a[i]
+// parseList parses a comma separated list. Empty entries are ignored.
+func parseList(list string) (retVal []string) {
+	for _, f := range strings.Split(list, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			retVal = append(retVal, f)
+		}
 	}
+	return retVal
 }
-
-type byteslice []byte
-
-func (s byteslice) Len() int           { return len(s) }
-func (s byteslice) Less(i, j int) bool { return s[i] < s[j] }
-func (s byteslice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
-
-type uintslice []uint
-
-func (s uintslice) Len() int           { return len(s) }
-func (s uintslice) Less(i, j int) bool { return s[i] < s[j] }
-func (s uintslice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
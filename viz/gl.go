@@ -1,17 +1,22 @@
-package main
+// Package viz draws the notes that are played as a grid of coloured cells.
+package viz
 
 import "C"
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 
+	"github.com/chewxy/gopherconsg2018/model"
 	"github.com/go-gl/gl/v4.1-core/gl"
 	"github.com/go-gl/glfw/v3.1/glfw"
 	colorful "github.com/lucasb-eyer/go-colorful"
+	"github.com/pkg/errors"
 )
 
 // http://antongerdelan.net/opengl/shaders.html
@@ -36,7 +41,7 @@ const (
 	  fragColour = inputColour;
 	}
     
-` + "\x00" // null termmination
+` + "\x00"  // null termmination
 
 	rows = 5
 	cols = 12
@@ -79,8 +84,26 @@ var wvibgyor = []colorful.Color{
 }
 
 var cellLookup = map[byte]struct{ x, y int }{}
-var cells [][]*cell
-var globalLock sync.Mutex
+
+// pending holds the latest state of each key that changed since the last frame. The drawing loop owns the cells and applies the pending changes,
+// so that players never wait for a frame to be drawn, and a note that stops is never lost.
+var pending = struct {
+	sync.Mutex
+	lit map[byte]bool
+}{lit: make(map[byte]bool)}
+var running atomic.Bool
+
+var logger *slog.Logger
+
+// SetLogger sets the logger of the visuals. It must be called before the visuals are started. Nil logs to the default logger.
+func SetLogger(l *slog.Logger) { logger = l }
+
+func vlog() *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
 
 type cell struct {
 	drawable uint32
@@ -103,37 +126,90 @@ func (c *cell) draw(program uint32) {
 	gl.DrawArrays(gl.TRIANGLES, 0, int32(len(rect)/3))
 }
 
-func updateCells(msg message) {
-	globalLock.Lock()
-	switch {
-	case msg.key == 255:
-		// do nothin
-	case msg.velocity == 0:
-		coord := cellLookup[msg.key]
-		cells[coord.y][coord.x].Color = cells[coord.y][coord.x].off
-	default:
+// Layout assigns a cell to each of the keys, and to the keys in between them.
+// It must be called before the visuals are started.
+func Layout(keys []byte) {
+	if len(keys) == 0 {
+		return
+	}
+	start := keys[0]
+	for i := 0; i < len(keys); i++ {
+		key := keys[i]
+
+		loc := int(key - start)
+		if loc <= 1 {
+			if _, ok := cellLookup[key]; ok {
+				continue
+			}
+			y := loc / cols
+			x := loc % cols
+
+			cellLookup[key] = struct{ x, y int }{x, y}
+		} else {
+			// fill in the missing keya so that when we press on them in the demo, accidentally, they light up
+			for j := loc; j >= 0; j-- {
+				key2 := key - byte(j)
+				if _, ok := cellLookup[key2]; ok {
+					continue
+				}
+				loc2 := int(key2 - start)
+				y := loc2 / cols
+				x := loc2 % cols
+				cellLookup[key2] = struct{ x, y int }{x, y}
+			}
+		}
+	}
+}
 
-		coord := cellLookup[msg.key]
-		log.Printf("coord %v", coord)
-		cells[coord.y][coord.x].Color = cells[coord.y][coord.x].on
+// Update lights up the cell of a note that starts, and dims the cell of a note that stops. It does nothing if the visuals are not running.
+// It never waits for a frame to be drawn: the cell changes in the next frame.
+func Update(msg model.Message) {
+	if !running.Load() || msg.Key == model.Rest {
+		return
+	}
+	pending.Lock()
+	pending.lit[msg.Key] = msg.Velocity > 0
+	pending.Unlock()
+}
 
+// apply applies the pending changes to the cells.
+func apply(cells [][]*cell) {
+	pending.Lock()
+	defer pending.Unlock()
+	for key, on := range pending.lit {
+		delete(pending.lit, key)
+		coord := cellLookup[key]
+		c := cells[coord.y][coord.x]
+		if !on {
+			c.Color = c.off
+			continue
+		}
+		vlog().Debug("Lighting up", "key", key, "x", coord.x, "y", coord.y)
+		c.Color = c.on
 	}
-	globalLock.Unlock()
 }
 
-// func mainGL(in <-chan message, out chan bool) {
-func mainGL() {
+// Run opens the window and draws the cells until the window is closed or the context is cancelled.
+// It must be called on the main thread.
+func Run(ctx context.Context) error {
 	runtime.LockOSThread()
 
-	window := initGlfw()
+	window, err := initGlfw()
+	if err != nil {
+		return errors.Wrap(err, "Unable to start visuals")
+	}
 	defer glfw.Terminate()
 
-	program := initOpenGL()
-	cells = makeCells()
-	for !window.ShouldClose() {
-		globalLock.Lock()
+	program, err := initOpenGL()
+	if err != nil {
+		return errors.Wrap(err, "Unable to start visuals")
+	}
+	cells := makeCells()
+	running.Store(true)
+	defer running.Store(false)
+	for !window.ShouldClose() && ctx.Err() == nil {
+		apply(cells)
 		draw(cells, window, program)
-		globalLock.Unlock()
 	}
 	// for {
 	// 	select {
@@ -158,12 +234,13 @@ func mainGL() {
 	// 		out <- window.ShouldClose()
 	// 	}
 	// }
+	return nil
 }
 
 // initGlfw initializes glfw and returns a Window to use.
-func initGlfw() *glfw.Window {
+func initGlfw() (*glfw.Window, error) {
 	if err := glfw.Init(); err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	glfw.WindowHint(glfw.Resizable, glfw.True)
@@ -174,35 +251,35 @@ func initGlfw() *glfw.Window {
 
 	window, err := glfw.CreateWindow(width, height, "Hello GopherCon Singapore", nil, nil)
 	if err != nil {
-		log.Printf("%p", window)
-		panic(err)
+		glfw.Terminate()
+		return nil, err
 	}
 	window.MakeContextCurrent()
 
-	return window
+	return window, nil
 }
 
 // initOpenGL initializes OpenGL and returns an intiialized program.
-func initOpenGL() uint32 {
+func initOpenGL() (uint32, error) {
 	if err := gl.Init(); err != nil {
-		panic(err)
+		return 0, err
 	}
 	version := gl.GoStr(gl.GetString(gl.VERSION))
-	log.Println("OpenGL version", version)
+	vlog().Info("Started visuals", "opengl", version)
 	var err error
 
 	if vertexShader, err = compileShader(vertexShaderSource, gl.VERTEX_SHADER); err != nil {
-		panic(err)
+		return 0, err
 	}
 	if fragmentShader, err = compileShader(fragmentShaderSource, gl.FRAGMENT_SHADER); err != nil {
-		panic(err)
+		return 0, err
 	}
 
 	prog := gl.CreateProgram()
 	gl.AttachShader(prog, vertexShader)
 	gl.AttachShader(prog, fragmentShader)
 	gl.LinkProgram(prog)
-	return prog
+	return prog, nil
 }
 
 func draw(cells [][]*cell, window *glfw.Window, program uint32) {